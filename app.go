@@ -1,146 +1,637 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/exaring/otelpgx"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgconn/ctxwatch"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
 const (
-	AppPortEnvKey       = "APP_PORT"
-	DbUserEnvKey        = "DB_USER"
-	DbPasswordEnvKey    = "DB_PASSWORD"
-	DbHostEnvKey        = "DB_HOST"
-	DbPortEnvKey        = "DB_PORT"
-	DbNameEnvKey        = "DB_NAME"
-	dbConnectionTimeout = 100 * time.Millisecond
-	dbPingTimeout       = 10 * time.Millisecond
+	AppPortEnvKey                = "APP_PORT"
+	InternalPortEnvKey           = "INTERNAL_PORT"
+	DatabaseURLEnvKey            = "DATABASE_URL"
+	DbReplicaURLEnvKey           = "DB_REPLICA_URL"
+	DbUserEnvKey                 = "DB_USER"
+	DbPasswordEnvKey             = "DB_PASSWORD"
+	DbHostEnvKey                 = "DB_HOST"
+	DbPortEnvKey                 = "DB_PORT"
+	DbNameEnvKey                 = "DB_NAME"
+	DbSSLModeEnvKey              = "DB_SSLMODE"
+	DbMaxConnsEnvKey             = "DB_MAX_CONNS"
+	DbMinConnsEnvKey             = "DB_MIN_CONNS"
+	DbConnectRetriesEnvKey       = "DB_CONNECT_RETRIES"
+	DbTxIsolationEnvKey          = "DB_TX_ISOLATION"
+	DbQueryExecModeEnvKey        = "DB_QUERY_EXEC_MODE"
+	AllowEmptyDbPasswordEnvKey   = "ALLOW_EMPTY_DB_PASSWORD"
+	DbAppNameEnvKey              = "DB_APP_NAME"
+	DbQueryTimeoutEnvKey         = "DB_QUERY_TIMEOUT"
+	DbConnectTimeoutEnvKey       = "DB_CONNECT_TIMEOUT"
+	DbPingTimeoutEnvKey          = "DB_PING_TIMEOUT"
+	DbLatencyThresholdEnvKey     = "DB_LATENCY_THRESHOLD"
+	HealthQueryEnvKey            = "HEALTH_QUERY"
+	DbMaxConnLifetimeEnvKey      = "DB_MAX_CONN_LIFETIME"
+	DbMaxConnIdleTimeEnvKey      = "DB_MAX_CONN_IDLE_TIME"
+	ShutdownTimeoutEnvKey        = "SHUTDOWN_TIMEOUT"
+	HTTPReadHeaderTimeoutEnvKey  = "HTTP_READ_HEADER_TIMEOUT"
+	HTTPReadTimeoutEnvKey        = "HTTP_READ_TIMEOUT"
+	HTTPWriteTimeoutEnvKey       = "HTTP_WRITE_TIMEOUT"
+	HTTPIdleTimeoutEnvKey        = "HTTP_IDLE_TIMEOUT"
+	BatchMaxSizeEnvKey           = "BATCH_MAX_SIZE"
+	LookupMaxIDsEnvKey           = "LOOKUP_MAX_IDS"
+	MaxNameLengthEnvKey          = "MAX_NAME_LENGTH"
+	EnablePprofEnvKey            = "ENABLE_PPROF"
+	MaxBodyBytesEnvKey           = "MAX_BODY_BYTES"
+	IdempotencyKeyTTLEnvKey      = "IDEMPOTENCY_KEY_TTL"
+	AllowResetEnvKey             = "ALLOW_RESET"
+	dbConnectInitialBackoff      = 100 * time.Millisecond
+	dbConnectMaxBackoff          = 5 * time.Second
+	defaultDbConnectRetries      = 10
+	defaultShutdownTimeout       = 15 * time.Second
+	defaultHTTPReadHeaderTimeout = 5 * time.Second
+	defaultHTTPReadTimeout       = 10 * time.Second
+	defaultHTTPWriteTimeout      = 10 * time.Second
+	defaultHTTPIdleTimeout       = 60 * time.Second
+	defaultDbQueryTimeout        = 3 * time.Second
+	defaultDbConnectTimeout      = 5 * time.Second
+	defaultDbPingTimeout         = 2 * time.Second
+	defaultDbLatencyThreshold    = 100 * time.Millisecond
+	defaultHealthQuery           = "SELECT 1"
+	defaultDbMaxConnLifetime     = time.Hour
+	defaultDbMaxConnIdleTime     = 30 * time.Minute
+	dbCancelDeadlineDelay        = time.Second
+	defaultDbMaxConns            = 10
+	defaultDbMinConns            = 1
+	pgUniqueViolationCode        = "23505"
+	pgCheckViolationCode         = "23514"
+	usersPath                    = "/api/users"
+	idempotencyKeyHeader         = "Idempotency-Key"
+	defaultUsersLimit            = 50
+	maxUsersLimit                = 200
+	defaultRecentUsers           = 10
+	maxRecentUsers               = 100
+	defaultBatchMaxSize          = 1000
+	defaultLookupMaxIDs          = 100
+	defaultMaxNameLength         = maxNameLengthLimit
+	maxNameLengthLimit           = 255
+	defaultMaxBodyBytes          = 1 << 20
+	defaultIdempotencyKeyTTL     = 24 * time.Hour
+	maxIdempotencyKeyLength      = 255
 )
 
 type App struct {
+	store UserStore
+	// db is only used for operational concerns such as health checks and
+	// shutdown; user handlers go through store.
 	db *pgxpool.Pool
+	// readDB is the read replica pool, or db when there is no replica.
+	readDB      *pgxpool.Pool
+	pingTimeout time.Duration
+	// latencyThreshold is the ping time above which the detailed health
+	// check reports the DB as degraded.
+	latencyThreshold  time.Duration
+	healthQuery       string
+	queryTimeout      time.Duration
+	maxBatchSize      int
+	maxLookupIDs      int
+	jsonLimits        jsonLimits
+	maxNameLength     int
+	idempotencyKeyTTL time.Duration
+	// allowReset enables DELETE /api/users, which wipes the table.
+	allowReset bool
+	// warmedUp is set once the pool has min conns open and pinged.
+	warmedUp atomic.Bool
+	// userEvents relays user_created notifications to SSE clients.
+	userEvents *broadcaster
+	// listenerConnected is set while the user_created listener is
+	// subscribed.
+	listenerConnected atomic.Bool
 }
 
-func initDB() (*pgxpool.Pool, error) {
-	dbPassword := os.Getenv(DbPasswordEnvKey)
-	dbUser := os.Getenv(DbUserEnvKey)
-	dbHost := os.Getenv(DbHostEnvKey)
-	dbPort := os.Getenv(DbPortEnvKey)
-	dbName := os.Getenv(DbNameEnvKey)
-	if dbUser == "" {
-		dbUser = "postgres"
+func connect(config *pgxpool.Config, timeout time.Duration) (*pgxpool.Pool, error) {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), timeout,
+	)
+	defer cancel()
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
 	}
-	if dbHost == "" {
-		dbHost = "localhost"
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
 	}
-	if dbPort == "" {
-		dbPort = "5432"
+	return pool, nil
+}
+
+func connectWithRetry(config *pgxpool.Config, attempts int, timeout time.Duration) (*pgxpool.Pool, error) {
+	backoff := dbConnectInitialBackoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var pool *pgxpool.Pool
+		pool, err = connect(config, timeout)
+		if err == nil {
+			return pool, nil
+		}
+		if attempt == attempts {
+			break
+		}
+		logger.Warn(
+			"Failed to connect to DB, retrying",
+			"attempt", attempt, "attempts", attempts, "retry_in", backoff, "error", err,
+		)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, dbConnectMaxBackoff)
 	}
-	if dbName == "" {
-		dbName = "postgres"
+	return nil, fmt.Errorf("connecting to DB after %d attempts: %w", attempts, err)
+}
+
+// warmUpPool opens the pool's min conns up front by holding that many
+// connections at once and pinging each, so the first requests after a
+// deploy do not pay for connection setup.
+func warmUpPool(ctx context.Context, pool *pgxpool.Pool) error {
+	n := max(int(pool.Config().MinConns), 1)
+	conns := make([]*pgxpool.Conn, 0, n)
+	defer func() {
+		for _, conn := range conns {
+			conn.Release()
+		}
+	}()
+
+	for range n {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+		if err := conn.Ping(ctx); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// config, err := pgx.ParseConfig(
-	// 	fmt.Sprintf(
-	// 		"postgres://%s:%s@%s:%s/%s?sslmode=disable",
-	// 		dbUser, dbPassword, dbHost, dbPort, dbName,
-	// 	),
-	// )
-	// if err != nil {
-	// 	return nil, err
-	// }
+func (app *App) warmUp(ctx context.Context) error {
+	if err := warmUpPool(ctx, app.db); err != nil {
+		return err
+	}
+	app.warmedUp.Store(true)
+	return nil
+}
 
-	ctx, cancel := context.WithTimeout(
-		context.Background(), dbConnectionTimeout,
+// newPool connects a pool to connString using the pool settings in cfg.
+func newPool(cfg *Config, connString, role string) (*pgxpool.Pool, error) {
+	config, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	// Cancel the running statement server-side when a query context expires,
+	// rather than only dropping the client connection.
+	config.ConnConfig.BuildContextWatcherHandler = func(conn *pgconn.PgConn) ctxwatch.Handler {
+		return &pgconn.CancelRequestContextWatcherHandler{
+			Conn:          conn,
+			DeadlineDelay: dbCancelDeadlineDelay,
+		}
+	}
+	config.ConnConfig.Tracer = multitracer.New(
+		otelpgx.NewTracer(),
+		&slowQueryTracer{threshold: cfg.SlowQueryThreshold, role: role},
 	)
-	defer cancel()
+	// Identifies our connections in pg_stat_activity. An application_name
+	// in the connection string is kept unless DB_APP_NAME overrides it.
+	if cfg.DbAppName != "" {
+		config.ConnConfig.RuntimeParams["application_name"] = cfg.DbAppName
+	} else if config.ConnConfig.RuntimeParams["application_name"] == "" {
+		config.ConnConfig.RuntimeParams["application_name"] = serviceName
+	}
+	if mode, ok := queryExecModes[cfg.DbQueryExecMode]; ok {
+		config.ConnConfig.DefaultQueryExecMode = mode
+	}
+	config.MaxConns = int32(cfg.DbMaxConns)
+	config.MinConns = int32(cfg.DbMinConns)
+	// Recycling connections lets the pool pick up failovers behind proxies
+	// such as PgBouncer or RDS Proxy.
+	config.MaxConnLifetime = cfg.DbMaxConnLifetime
+	config.MaxConnIdleTime = cfg.DbMaxConnIdleTime
 
-	pool, err := pgxpool.New(
-		ctx, fmt.Sprintf(
-			"postgres://%s:%s@%s:%s/%s?sslmode=disable",
-			dbUser, dbPassword, dbHost, dbPort, dbName,
-		),
-	)
-	// conn, err := pgx.ConnectConfig(ctx, config)
+	pool, err := connectWithRetry(config, cfg.DbConnectRetries, cfg.DbConnectTimeout)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("Connected to DB %s:%s\n", dbHost, dbPort)
-
-	_, err = pool.Exec(
-		context.Background(),
-		"CREATE TABLE IF NOT EXISTS users (id SERIAL PRIMARY KEY, name TEXT NOT NULL);",
+	logger.Info(
+		"Connected to DB",
+		"role", role, "host", config.ConnConfig.Host, "port", config.ConnConfig.Port,
 	)
+	return pool, nil
+}
+
+// initDB connects to the primary and runs migrations on it, then connects
+// to the read replica when DB_REPLICA_URL is set. readDB is the primary
+// itself when there is no replica.
+func initDB(cfg *Config) (db, readDB *pgxpool.Pool, err error) {
+	db, err = newPool(cfg, cfg.connString(), "primary")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if err := runMigrations(context.Background(), db); err != nil {
+		db.Close()
+		return nil, nil, err
 	}
 
-	return pool, nil
+	if cfg.DbReplicaURL == "" {
+		return db, db, nil
+	}
+	readDB, err = newPool(cfg, cfg.DbReplicaURL, "replica")
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("replica: %w", err)
+	}
+	return db, readDB, nil
 }
 
-func initApp() (*App, error) {
-	db, err := initDB()
+func initApp(cfg *Config) (*App, error) {
+	logger.Info(
+		"Database timeouts",
+		"connect_timeout", cfg.DbConnectTimeout, "ping_timeout", cfg.DbPingTimeout,
+	)
+
+	db, readDB, err := initDB(cfg)
 	if err != nil {
-		log.Fatalf("Failed to init db: %v\n", err)
-		return nil, err
+		return nil, fmt.Errorf("init db: %w", err)
+	}
+	registerPoolMetrics(db)
+
+	app := &App{
+		store: newPgUserStore(
+			db, readDB, cfg.DbTxIsolation, cfg.DbQueryRetries,
+			newDBBreaker(cfg.DbBreakerFailures, cfg.DbBreakerProbes, cfg.DbBreakerOpenTimeout),
+		),
+		db:                db,
+		readDB:            readDB,
+		pingTimeout:       cfg.DbPingTimeout,
+		latencyThreshold:  cfg.DbLatencyThreshold,
+		healthQuery:       cfg.HealthQuery,
+		queryTimeout:      cfg.DbQueryTimeout,
+		maxBatchSize:      cfg.BatchMaxSize,
+		maxLookupIDs:      cfg.LookupMaxIDs,
+		jsonLimits:        jsonLimits{maxDepth: cfg.JSONMaxDepth, maxElements: cfg.JSONMaxElements},
+		maxNameLength:     cfg.MaxNameLength,
+		idempotencyKeyTTL: cfg.IdempotencyKeyTTL,
+		allowReset:        cfg.AllowReset,
+		userEvents:        newBroadcaster(),
 	}
 
-	return &App{db}, err
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DbConnectTimeout)
+	defer cancel()
+	if err := app.warmUp(ctx); err != nil {
+		// Not fatal: readyz keeps reporting not ready and retries the warm-up.
+		logger.Warn("Failed to warm up DB pool", "error", err)
+	} else {
+		logger.Info("Warmed up DB pool", "conns", db.Stat().TotalConns())
+	}
+	return app, nil
+}
+
+func (app *App) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), app.queryTimeout)
+}
+
+// statusClientClosedRequest is the nginx convention for a request the
+// client gave up on. Nothing is sent to the client, but it keeps those
+// requests apart from real failures in logs and metrics.
+const statusClientClosedRequest = 499
+
+// queryErrorStatus classifies a failed query run under ctx.
+func queryErrorStatus(ctx context.Context, err error) int {
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case isBreakerOpen(err):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// logQueryError logs a failed query, at debug level when the client went
+// away and at warn level when it timed out, so neither trips error alerts.
+func logQueryError(ctx context.Context, err error, msg string, args ...any) {
+	args = append(args, "error", err)
+	switch queryErrorStatus(ctx, err) {
+	case statusClientClosedRequest:
+		logger.DebugContext(ctx, msg, args...)
+	case http.StatusGatewayTimeout, http.StatusServiceUnavailable:
+		logger.WarnContext(ctx, msg, args...)
+	default:
+		logger.ErrorContext(ctx, msg, args...)
+	}
+}
+
+// writeQueryError logs err with logMsg and logArgs and responds with 504
+// when the query ran out of time, with no body when the client cancelled,
+// and with a 500 carrying message otherwise.
+func writeQueryError(ctx context.Context, w http.ResponseWriter, err error, message, logMsg string, logArgs ...any) {
+	logQueryError(ctx, err, logMsg, logArgs...)
+	switch status := queryErrorStatus(ctx, err); status {
+	case statusClientClosedRequest:
+		w.WriteHeader(status)
+	case http.StatusGatewayTimeout:
+		writeError(w, status, "Database query timed out")
+	case http.StatusServiceUnavailable:
+		writeError(w, status, "Database unavailable, try again later")
+	default:
+		writeError(w, status, message)
+	}
+}
+
+type ErrorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// writeJSON responds with status and payload encoded as JSON. The payload
+// is encoded before anything is written, so a value that fails to encode
+// becomes a clean 500 instead of a truncated body behind the original
+// status.
+func writeJSON(w http.ResponseWriter, status int, payload any) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if _, ok := w.(*prettyWriter); ok {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(payload); err != nil {
+		logger.Error("Error encoding JSON response", "error", err)
+		status = http.StatusInternalServerError
+		buf.Reset()
+		_ = json.NewEncoder(&buf).Encode(ErrorResponse{Error: "Internal server error", Status: status})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		logger.Debug("Error writing JSON response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, ErrorResponse{Error: message, Status: status})
 }
 
 type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Email     *string   `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	// UpdatedAt is set by a trigger on every UPDATE of the row.
+	UpdatedAt time.Time  `json:"updated_at,omitzero"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type GetUsersResponse struct {
+	// Users is never nil, so an empty page is {"users": []} with status 200
+	// rather than null or a 204; listUsersPage guarantees it.
 	Users []User `json:"users"`
+	Total int    `json:"total"`
+	// NextCursor is only set in cursor mode, and is empty on the last page.
+	NextCursor *string `json:"next_cursor,omitempty"`
 }
 
-func (app *App) handleGetUsers(w http.ResponseWriter, r *http.Request) {
-	_ = r
-	w.Header().Set("Content-Type", "application/json")
+func parseQueryInt(r *http.Request, key string, def int) (int, error) {
+	raw := r.URL.Query().Get(key)
+	if raw == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return v, nil
+}
+
+// parseSort parses a comma-separated list of sort keys such as
+// name,-created_at, where a leading - sorts in descending order.
+func parseSort(raw string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		column, desc := strings.CutPrefix(field, "-")
+		if _, ok := sortColumns[column]; !ok {
+			return nil, fmt.Errorf("unknown sort key '%s'", field)
+		}
+		keys = append(keys, SortKey{Column: column, Desc: desc})
+	}
+	return keys, nil
+}
+
+// nameSearchPredicate matches names containing parameter $n, which must
+// already be escaped with escapeLike.
+func nameSearchPredicate(n int) string {
+	return fmt.Sprintf(`name ILIKE '%%' || $%d || '%%' ESCAPE '\'`, n)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+func includeDeleted(r *http.Request) bool {
+	return r.URL.Query().Get("include_deleted") == "true"
+}
+
+func userFilter(r *http.Request) UserFilter {
+	return UserFilter{Query: r.URL.Query().Get("q"), IncludeDeleted: includeDeleted(r)}
+}
+
+// listUsersParams reads the paging, filter and sort query parameters shared
+// by every version of the list endpoint.
+func listUsersParams(r *http.Request) (ListUsersParams, error) {
+	limit, err := parseQueryInt(r, "limit", defaultUsersLimit)
+	if err != nil {
+		return ListUsersParams{}, err
+	}
+	offset, err := parseQueryInt(r, "offset", 0)
+	if err != nil {
+		return ListUsersParams{}, err
+	}
+	params := ListUsersParams{
+		UserFilter: userFilter(r),
+		Limit:      min(limit, maxUsersLimit),
+		Offset:     offset,
+	}
+	if r.URL.Query().Has("after") {
+		if r.URL.Query().Has("offset") {
+			return ListUsersParams{}, errors.New("after and offset cannot be combined")
+		}
+		after, err := parseQueryInt(r, "after", 0)
+		if err != nil {
+			return ListUsersParams{}, err
+		}
+		if params.Limit == 0 {
+			return ListUsersParams{}, errors.New("limit must be positive when using after")
+		}
+		params.After = &after
+	}
+	if raw := r.URL.Query().Get("sort"); raw != "" {
+		if params.After != nil {
+			return ListUsersParams{}, errors.New("sort and after cannot be combined")
+		}
+		params.Sort, err = parseSort(raw)
+		if err != nil {
+			return ListUsersParams{}, err
+		}
+	}
+	return params, nil
+}
 
-	rows, err := app.db.Query(r.Context(), "SELECT * FROM users;")
+func (app *App) handleGetUsers(w http.ResponseWriter, r *http.Request) {
+	params, err := listUsersParams(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	defer rows.Close()
 
-	users := make([]User, 0)
-	for rows.Next() {
-		var id int
-		var name string
-		err = rows.Scan(&id, &name)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if accepts(r, ndjsonContentType) || accepts(r, csvContentType) {
+		// Exports are not capped.
+		params.Limit = noLimit
+		if r.URL.Query().Has("limit") {
+			params.Limit, _ = parseQueryInt(r, "limit", 0)
 		}
-		users = append(users, User{ID: id, Name: name})
+		if accepts(r, csvContentType) {
+			app.streamUsersCSV(w, r, params)
+		} else {
+			app.streamUsersNDJSON(w, r, params)
+		}
+		return
 	}
 
-	response := GetUsersResponse{Users: users}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding JSON response: %v\n", err)
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	page, err := listUsersPage(ctx, app.store, params)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to list users", "Error listing users")
+		return
 	}
+
+	writeJSON(w, http.StatusOK, GetUsersResponse{Users: page.Users, Total: page.Total, NextCursor: page.NextCursor})
+}
+
+type CountUsersResponse struct {
+	Count int `json:"count"`
+}
+
+type ResetUsersResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+func (app *App) handleCountUsers(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	count, err := app.store.Count(ctx, userFilter(r))
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to count users", "Error counting users")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, CountUsersResponse{Count: count})
+}
+
+type UserStatsResponse struct {
+	Total           int `json:"total"`
+	CreatedToday    int `json:"created_today"`
+	CreatedThisWeek int `json:"created_this_week"`
+}
+
+func (app *App) handleUserStats(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	stats, err := app.store.Stats(ctx)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to compute user stats", "Error computing user stats")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UserStatsResponse{
+		Total:           stats.Total,
+		CreatedToday:    stats.CreatedToday,
+		CreatedThisWeek: stats.CreatedThisWeek,
+	})
+}
+
+type RecentUsersResponse struct {
+	Users []User `json:"users"`
+}
+
+// handleRecentUsers returns the n newest live users, newest first.
+func (app *App) handleRecentUsers(w http.ResponseWriter, r *http.Request) {
+	n, err := parseQueryInt(r, "n", defaultRecentUsers)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	users, err := app.store.List(ctx, ListUsersParams{
+		Limit: min(n, maxRecentUsers),
+		// created_at can tie, and IDs follow insertion order.
+		Sort: []SortKey{{Column: "created_at", Desc: true}, {Column: "id", Desc: true}},
+	})
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to list users", "Error listing recent users")
+		return
+	}
+	if users == nil {
+		users = []User{}
+	}
+
+	writeJSON(w, http.StatusOK, RecentUsersResponse{Users: users})
 }
 
 type AddUserRequest struct {
-	Name string `json:"name"`
+	Name  string  `json:"name"`
+	Email *string `json:"email"`
 }
 
 type UserResponse struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Email     *string   `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	// UpdatedAt is set by a trigger on every UPDATE of the row.
+	UpdatedAt time.Time  `json:"updated_at,omitzero"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 func (app *App) handleAddUser(w http.ResponseWriter, r *http.Request) {
@@ -148,83 +639,716 @@ func (app *App) handleAddUser(w http.ResponseWriter, r *http.Request) {
 		_ = Body.Close()
 	}(r.Body)
 
-	w.Header().Set("Content-Type", "application/json")
-
-	decoder := json.NewDecoder(r.Body)
-	decoder.DisallowUnknownFields()
 	var req AddUserRequest
-	if err := decoder.Decode(&req); err != nil {
-		http.Error(w, `{"error": "Invalid request payload"}`, http.StatusBadRequest)
-		log.Printf("Error decoding request body: %v\n", err)
+	if err := decodeJSON(r, &req, app.jsonLimits); err != nil {
+		writeDecodeError(w, r, err)
 		return
 	}
 
-	if req.Name == "" {
-		http.Error(w, `{"error": "Name is required"}`, http.StatusBadRequest)
+	if r.URL.Query().Get("validate") == "true" {
+		app.handleValidateUser(w, r, req)
 		return
 	}
 
-	var newUserID int
-	err := app.db.QueryRow(
-		r.Context(),
-		"INSERT INTO users (name) VALUES ($1) RETURNING id",
-		req.Name,
-	).Scan(&newUserID)
+	newUser, err := validateNewUser(req, app.maxNameLength)
+	if err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
 
+	var user User
+	replayed := false
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(
+				w, http.StatusBadRequest,
+				fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength),
+			)
+			return
+		}
+		user, replayed, err = app.store.CreateIdempotent(ctx, key, app.idempotencyKeyTTL, newUser)
+	} else {
+		user, err = app.store.Create(ctx, newUser)
+	}
+	if errors.Is(err, ErrNameExists) {
+		writeError(w, http.StatusConflict, "name already exists")
+		return
+	}
+	if errors.Is(err, ErrNameTooLong) {
+		writeError(w, http.StatusBadRequest, "name is too long")
+		return
+	}
+	if errors.Is(err, ErrEmailExists) {
+		writeError(w, http.StatusConflict, "email already exists")
+		return
+	}
 	if err != nil {
-		http.Error(w, `{"error": "Failed to add user to database"}`, http.StatusInternalServerError)
-		log.Printf("Error inserting user: %v\n", err)
+		writeQueryError(ctx, w, err, "Failed to add user to database", "Error inserting user")
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	response := UserResponse{ID: newUserID, Name: req.Name}
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		log.Printf("Error encoding JSON response: %v\n", err)
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
 	}
+	w.Header().Set("Location", externalPath(r, userURL(user.ID)))
+	writeJSON(w, http.StatusCreated, UserResponse(user))
 }
 
-func (app *App) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
-	_ = r
+func userURL(id int) string {
+	return usersPath + "/" + strconv.Itoa(id)
+}
+
+func parseUserID(r *http.Request) (int, error) {
+	return strconv.Atoi(r.PathValue("id"))
+}
+
+func (app *App) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	if user, ok := app.getUser(w, r); ok {
+		writeJSON(w, http.StatusOK, UserResponse(user))
+	}
+}
+
+// getUser loads the user a GET asks for and sets its ETag. It returns false
+// once it has responded itself: with an error, or with 304 when the client
+// already has this version.
+func (app *App) getUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user id")
+		return User{}, false
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	user, err := app.store.Get(ctx, id, includeDeleted(r))
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return User{}, false
+	}
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to get user from database", "Error getting user", "id", id)
+		return User{}, false
+	}
+
+	etag := userETag(user)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return User{}, false
+	}
+	return user, true
+}
+
+// handleHeadUser answers HEAD with the headers a GET would return, so it
+// fetches and encodes the user to get Content-Length and the ETag right.
+// The server drops the body of a HEAD response.
+func (app *App) handleHeadUser(w http.ResponseWriter, r *http.Request) {
+	app.handleGetUser(w, r)
+}
+
+type UpdateUserRequest struct {
+	Name string `json:"name"`
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+func (app *App) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	id, err := parseUserID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	var req UpdateUserRequest
+	if err := decodeJSON(r, &req, app.jsonLimits); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	name, err := validateName(req.Name, app.maxNameLength)
+	if err != nil {
+		writeValidationError(w, fieldError("name", err))
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
 	defer cancel()
 
-	err := app.db.Ping(ctx)
+	user, err := app.store.Update(ctx, id, name)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if errors.Is(err, ErrNameExists) {
+		writeError(w, http.StatusConflict, "name already exists")
+		return
+	}
+	if errors.Is(err, ErrNameTooLong) {
+		writeError(w, http.StatusBadRequest, "name is too long")
+		return
+	}
 	if err != nil {
-		log.Printf("Health check ERROR: %v\n", err.Error())
-		w.WriteHeader(http.StatusBadGateway)
+		writeQueryError(ctx, w, err, "Failed to update user in database", "Error updating user", "id", id)
 		return
 	}
 
-	log.Printf("Health check OK")
+	writeJSON(w, http.StatusOK, UserResponse(user))
 }
 
-func main() {
-	app, err := initApp()
+// Optional distinguishes a JSON field that was omitted (Set is false) from
+// one explicitly set to null (Set is true and Null is true).
+type Optional[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+func (o *Optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Null = true
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+type PatchUserRequest struct {
+	Name Optional[string] `json:"name"`
+}
+
+func (app *App) handlePatchUser(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	id, err := parseUserID(r)
 	if err != nil {
-		log.Fatalf("Failed to init app: %v\n", err)
+		writeError(w, http.StatusBadRequest, "Invalid user id")
 		return
 	}
 
-	http.HandleFunc(
-		"/api/users", func(w http.ResponseWriter, r *http.Request) {
-			switch r.Method {
-			case http.MethodGet:
-				app.handleGetUsers(w, r)
-			case http.MethodPost:
-				app.handleAddUser(w, r)
+	var req PatchUserRequest
+	if err := decodeJSON(r, &req, app.jsonLimits); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	var patch UserPatch
+	if req.Name.Set {
+		if req.Name.Null {
+			writeValidationError(w, fieldError("name", errNameNull))
+			return
+		}
+		name, err := validateName(req.Name.Value, app.maxNameLength)
+		if err != nil {
+			writeValidationError(w, fieldError("name", err))
+			return
+		}
+		patch.Name = &name
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	user, err := app.store.Patch(ctx, id, patch)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if errors.Is(err, ErrNameExists) {
+		writeError(w, http.StatusConflict, "name already exists")
+		return
+	}
+	if errors.Is(err, ErrNameTooLong) {
+		writeError(w, http.StatusBadRequest, "name is too long")
+		return
+	}
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to update user in database", "Error patching user", "id", id)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UserResponse(user))
+}
+
+func (app *App) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	err = app.store.Delete(ctx, id)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to delete user from database", "Error deleting user", "id", id)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResetUsers empties the users table for test environments. It is
+// refused unless ALLOW_RESET is true.
+func (app *App) handleResetUsers(w http.ResponseWriter, r *http.Request) {
+	if !app.allowReset {
+		writeError(w, http.StatusForbidden, "Reset is disabled")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	n, err := app.store.Reset(ctx)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to reset users", "Error resetting users")
+		return
+	}
+
+	logger.WarnContext(ctx, "Users reset", "deleted", n)
+	writeJSON(w, http.StatusOK, ResetUsersResponse{Deleted: n})
+}
+
+func (app *App) handleRestoreUser(w http.ResponseWriter, r *http.Request) {
+	id, err := parseUserID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	user, err := app.store.Restore(ctx, id)
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if errors.Is(err, ErrNameExists) {
+		writeError(w, http.StatusConflict, "name already exists")
+		return
+	}
+	if errors.Is(err, ErrNameTooLong) {
+		writeError(w, http.StatusBadRequest, "name is too long")
+		return
+	}
+	if errors.Is(err, ErrEmailExists) {
+		writeError(w, http.StatusConflict, "email already exists")
+		return
+	}
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to restore user in database", "Error restoring user", "id", id)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, UserResponse(user))
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	DB     string `json:"db"`
+}
+
+func (app *App) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), app.pingTimeout)
+	defer cancel()
+
+	response := HealthResponse{Status: "ok", DB: "up"}
+	status := http.StatusOK
+	if err := app.db.Ping(ctx); err != nil {
+		logger.ErrorContext(r.Context(), "Health check failed", "error", err)
+		response = HealthResponse{Status: "unavailable", DB: "down"}
+		status = http.StatusServiceUnavailable
+	} else {
+		logger.DebugContext(r.Context(), "Health check OK")
+	}
+
+	writeJSON(w, status, response)
+}
+
+func (app *App) handleLivez(w http.ResponseWriter, r *http.Request) {
+	_ = r
+	w.WriteHeader(http.StatusOK)
+}
+
+type DependencyHealth struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+type DetailedHealthResponse struct {
+	Status  string            `json:"status"`
+	DB      DependencyHealth  `json:"db"`
+	Replica *DependencyHealth `json:"replica,omitempty"`
+}
+
+// pingHealth times a ping of pool, reporting it as degraded when it took
+// longer than the latency threshold.
+func (app *App) pingHealth(ctx context.Context, pool *pgxpool.Pool, name string) DependencyHealth {
+	start := time.Now()
+	err := pool.Ping(ctx)
+	elapsed := time.Since(start)
+	health := DependencyHealth{Status: "ok", LatencyMs: float64(elapsed.Microseconds()) / 1000}
+	switch {
+	case err != nil:
+		logger.ErrorContext(ctx, "Detailed health check failed", "dependency", name, "error", err)
+		health.Status = "down"
+	case elapsed > app.latencyThreshold:
+		logger.WarnContext(ctx, "Slow DB ping", "dependency", name, "latency", elapsed)
+		health.Status = "degraded"
+	}
+	return health
+}
+
+// handleDetailedHealth reports how long each database takes to answer a
+// ping. Slow pings make the status degraded but still respond 200, so
+// probes get an early warning before the database actually fails.
+func (app *App) handleDetailedHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), app.pingTimeout)
+	defer cancel()
+
+	response := DetailedHealthResponse{Status: "ok", DB: app.pingHealth(ctx, app.db, "db")}
+	deps := []DependencyHealth{response.DB}
+	if app.readDB != app.db {
+		replica := app.pingHealth(ctx, app.readDB, "replica")
+		response.Replica = &replica
+		deps = append(deps, replica)
+	}
+
+	status := http.StatusOK
+	for _, dep := range deps {
+		switch dep.Status {
+		case "down":
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		case "degraded":
+			if status == http.StatusOK {
+				response.Status = "degraded"
 			}
-		},
+		}
+	}
+
+	writeJSON(w, status, response)
+}
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// checkQuery runs the health query against pool. Unlike Ping it fails when
+// the database accepts connections but not statements, and it also fails
+// when the query returns no rows.
+func (app *App) checkQuery(ctx context.Context, pool *pgxpool.Pool) error {
+	rows, err := pool.Query(ctx, app.healthQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return errors.New("health query returned no rows")
+	}
+	return nil
+}
+
+// checkSchema fails until the users table has every column the store reads,
+// which catches a database whose migrations have not been applied yet.
+func (app *App) checkSchema(ctx context.Context) error {
+	_, err := app.db.Exec(ctx, "SELECT "+userColumns+" FROM users LIMIT 1")
+	return err
+}
+
+func (app *App) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), app.pingTimeout)
+	defer cancel()
+
+	response := ReadinessResponse{
+		Status: "ok",
+		Checks: map[string]string{"db": "ok", "schema": "ok", "warmup": "ok", "listener": "ok"},
+	}
+	status := http.StatusOK
+	if !app.listenerConnected.Load() {
+		response.Status = "unavailable"
+		response.Checks["listener"] = "disconnected"
+		status = http.StatusServiceUnavailable
+	}
+	if !app.warmedUp.Load() {
+		if err := app.warmUp(ctx); err != nil {
+			logger.WarnContext(r.Context(), "DB pool warm-up failed", "error", err)
+			response.Status = "unavailable"
+			response.Checks["warmup"] = "pending"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if app.readDB != app.db {
+		response.Checks["replica"] = "ok"
+		if err := app.checkQuery(ctx, app.readDB); err != nil {
+			logger.ErrorContext(r.Context(), "Replica readiness check failed", "error", err)
+			response.Status = "unavailable"
+			response.Checks["replica"] = "unreachable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if err := app.checkQuery(ctx, app.db); err != nil {
+		logger.ErrorContext(r.Context(), "Readiness check failed", "error", err)
+		response.Status = "unavailable"
+		response.Checks["db"] = "unreachable"
+		response.Checks["schema"] = "unknown"
+		status = http.StatusServiceUnavailable
+	} else if err := app.checkSchema(ctx); err != nil {
+		logger.ErrorContext(r.Context(), "Schema check failed", "error", err)
+		response.Status = "unavailable"
+		response.Checks["schema"] = "missing"
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, response)
+}
+
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// newServer returns a server for handler with the configured timeouts.
+func newServer(cfg *Config, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Handler: handler,
+		// Time allowed to read request headers, HTTP_READ_HEADER_TIMEOUT (default 5s).
+		ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+		// Time allowed to read the whole request including the body, HTTP_READ_TIMEOUT (default 10s).
+		ReadTimeout: cfg.HTTPReadTimeout,
+		// Time allowed to write the response, HTTP_WRITE_TIMEOUT (default 10s).
+		WriteTimeout: cfg.HTTPWriteTimeout,
+		// Time a keep-alive connection may sit idle, HTTP_IDLE_TIMEOUT (default 60s).
+		IdleTimeout: cfg.HTTPIdleTimeout,
+		TLSConfig:   tlsConfig,
+	}
+}
+
+// serve runs server on listener until it is shut down, exiting the process
+// if it fails for any other reason.
+func serve(server *http.Server, listener net.Listener, name string) {
+	tlsEnabled := server.TLSConfig != nil
+	logger.Info("Listening", "server", name, "addr", listener.Addr().String(), "tls", tlsEnabled)
+	var err error
+	if tlsEnabled {
+		// The certificate comes from TLSConfig.GetCertificate.
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Failed to serve", "server", name, "error", err)
+		os.Exit(1)
+	}
+}
+
+func main() {
+	envFile, err := loadEnvFile()
+	if err != nil {
+		logger.Error("Failed to load env file", "error", err)
+		os.Exit(1)
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		var cfgErr *ConfigError
+		if errors.As(err, &cfgErr) {
+			logger.Error("Invalid configuration", "problems", cfgErr.Problems)
+		} else {
+			logger.Error("Failed to load configuration", "error", err)
+		}
+		os.Exit(1)
+	}
+	logger = newLogger(cfg.LogLevel)
+	if envFile != "" {
+		logger.Info("Loaded env file", "path", envFile)
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		logger.Error("Failed to init tracing", "error", err)
+		os.Exit(1)
+	}
+
+	app, err := initApp(cfg)
+	if err != nil {
+		logger.Error("Failed to init app", "error", err)
+		os.Exit(1)
+	}
+
+	listenCtx, stopListening := context.WithCancel(context.Background())
+	defer stopListening()
+	go Listen(listenCtx, app.db, userCreatedChannel, app.userEvents.handleNotification, &app.listenerConnected)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+usersPath, app.handleGetUsers)
+	mux.HandleFunc("POST "+usersPath, app.handleAddUser)
+	mux.HandleFunc("GET "+usersPath+"/count", app.handleCountUsers)
+	mux.HandleFunc("GET "+usersPath+"/stats", app.handleUserStats)
+	mux.HandleFunc("GET "+usersPath+"/recent", app.handleRecentUsers)
+	mux.HandleFunc("GET "+usersPath+"/stream", app.handleUserStream)
+	mux.HandleFunc("POST "+usersPath+"/batch", app.handleBatchAddUsers)
+	mux.HandleFunc("POST "+usersPath+"/import", app.handleImportUsers)
+	mux.HandleFunc("POST "+usersPath+"/bulk-delete", app.handleBulkDeleteUsers)
+	mux.HandleFunc("POST "+usersPath+"/lookup", app.handleLookupUsers)
+	mux.HandleFunc("GET "+usersPath+"/{id}", app.handleGetUser)
+	mux.HandleFunc("HEAD "+usersPath+"/{id}", app.handleHeadUser)
+	mux.HandleFunc("PUT "+usersPath+"/{id}", app.handleUpdateUser)
+	mux.HandleFunc("PATCH "+usersPath+"/{id}", app.handlePatchUser)
+	mux.HandleFunc("DELETE "+usersPath, app.handleResetUsers)
+	mux.HandleFunc("DELETE "+usersPath+"/{id}", app.handleDeleteUser)
+	mux.HandleFunc("POST "+usersPath+"/{id}/restore", app.handleRestoreUser)
+	mux.HandleFunc("GET "+auditPath, app.handleGetAudit)
+
+	mux.HandleFunc("GET "+usersV2Path, app.handleGetUsersV2)
+	mux.HandleFunc("GET "+usersV2Path+"/{id}", app.handleGetUserV2)
+
+	mux.HandleFunc("GET "+openAPIPath, handleOpenAPI(cfg.BasePath))
+
+	// With INTERNAL_PORT set, the operator endpoints move to their own
+	// server so the public port only serves the API.
+	internalMux := mux
+	if cfg.InternalPort != "" {
+		internalMux = http.NewServeMux()
+	}
+	internalMux.HandleFunc("GET /_internal/health", app.handleHealthCheck)
+	internalMux.HandleFunc("GET /_internal/livez", app.handleLivez)
+	internalMux.HandleFunc("GET /_internal/readyz", app.handleReadyz)
+	internalMux.HandleFunc("GET /_internal/healthz/detailed", app.handleDetailedHealth)
+	internalMux.HandleFunc("GET /_internal/version", handleVersion)
+	internalMux.Handle("/metrics", promhttp.Handler())
+	if cfg.EnablePprof {
+		// Not exempt from the API key middleware, so profiles and pool stats
+		// stay private whenever API keys are configured.
+		registerPprof(internalMux)
+		internalMux.HandleFunc("GET /debug/pool", app.handlePoolStats)
+		logger.Warn("Debug endpoints are enabled", "paths", []string{"/debug/pprof/", "/debug/pool"})
+	}
+
+	inFlight := newInFlightTracker()
+	handler := chain(
+		jsonMuxErrors(mux),
+		inFlight.track,
+		logRequests,
+		stripBasePath(cfg.BasePath, cfg.BasePathExempt),
+		securityHeaders(cfg.SecurityHeaders, cfg.HSTSMaxAge),
+		instrumentRequests(mux),
+		compress,
+		recoverPanics,
+		requestTimeout(cfg.RequestTimeout, isStreamingRequest),
+		limitBody(int64(cfg.MaxBodyBytes)),
+		logBodies(cfg.LogBodies, cfg.LogBodiesMaxBytes, cfg.LogRedactKeys, isStreamingRequest),
+		cors(cfg.AllowedOrigins, cfg.CORSAllowedHeaders, cfg.CORSMaxAge),
+		rateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.TrustProxy, "/_internal/", "/metrics"),
+		requireAPIKey(cfg.APIKeys, "/_internal/", "/metrics", openAPIPath),
+		requireJWT(newJWTVerifier(cfg), "/_internal/", "/metrics", openAPIPath),
+		prettyJSON,
 	)
+	tlsConfig, err := newTLSConfig(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		logger.Error("Failed to load TLS certificate", "error", err)
+		os.Exit(1)
+	}
+
+	server := newServer(cfg, otelhttp.NewHandler(handler, "http.server"), tlsConfig)
+	server.RegisterOnShutdown(app.userEvents.close)
+	listener, err := listen(cfg.BindAddr, cfg.Port)
+	if err != nil {
+		logger.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+	servers := []*http.Server{server}
+	go serve(server, listener, "api")
 
-	http.HandleFunc(
-		"/_internal/health", app.handleHealthCheck,
+	if cfg.InternalPort != "" {
+		internalHandler := chain(
+			jsonMuxErrors(internalMux),
+			inFlight.track,
+			logRequests,
+			instrumentRequests(internalMux),
+			recoverPanics,
+			requireAPIKey(cfg.APIKeys, "/_internal/", "/metrics"),
+		)
+		internalServer := newServer(cfg, internalHandler, tlsConfig)
+		internalListener, err := listen(internalBindHost(cfg.BindAddr), cfg.InternalPort)
+		if err != nil {
+			logger.Error("Failed to listen", "server", "internal", "error", err)
+			os.Exit(1)
+		}
+		servers = append(servers, internalServer)
+		go serve(internalServer, internalListener, "internal")
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	logger.Info("Shutting down", "signal", sig.String(), "in_flight", inFlight.count.Load())
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), cfg.ShutdownTimeout,
 	)
+	defer cancel()
 
-	port := os.Getenv(AppPortEnvKey)
-	if port == "" {
-		port = "8080"
+	stopListening()
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logger.Error("Error shutting down server", "error", err)
+				// Past SHUTDOWN_TIMEOUT, drop the connections still open.
+				_ = s.Close()
+			}
+		}()
+	}
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	ticker := time.NewTicker(time.Second)
+drain:
+	for {
+		select {
+		case <-drained:
+			break drain
+		case <-ticker.C:
+			logger.Info("Draining requests", "in_flight", inFlight.count.Load())
+		}
+	}
+	ticker.Stop()
+	// Close doesn't wait for handlers, so anything still tracked here has
+	// outlived the shutdown timeout.
+	if n := inFlight.count.Load(); n > 0 {
+		logger.Warn("Requests still in flight at shutdown deadline", "count", n, "paths", inFlight.paths())
+	}
+	if app.readDB != app.db {
+		app.readDB.Close()
+	}
+	app.db.Close()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Error("Error shutting down tracing", "error", err)
 	}
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	logger.Info("Shutdown complete")
 }
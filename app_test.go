@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// emptyUserStore lists no users. Methods the tests don't call are left to
+// the nil embedded interface and panic if reached.
+type emptyUserStore struct {
+	UserStore
+	list []User
+}
+
+func (s emptyUserStore) List(context.Context, ListUsersParams) ([]User, error) {
+	return s.list, nil
+}
+
+func (s emptyUserStore) Count(context.Context, UserFilter) (int, error) {
+	return 0, nil
+}
+
+func TestGetUsersEmptyListIsArray(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		list  []User
+	}{
+		{name: "empty slice", list: []User{}},
+		{name: "nil slice", list: nil},
+		{name: "search", query: "?q=nobody", list: nil},
+		{name: "cursor", query: "?after=10", list: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{store: emptyUserStore{list: tt.list}, queryTimeout: time.Second}
+			w := httptest.NewRecorder()
+			app.handleGetUsers(w, httptest.NewRequest(http.MethodGet, usersPath+tt.query, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			body := w.Body.String()
+			if !strings.Contains(body, `"users":[]`) {
+				t.Errorf("body = %s, want users serialized as []", body)
+			}
+		})
+	}
+}
+
+// oneUserStore holds a single user, which Get returns by ID.
+type oneUserStore struct {
+	UserStore
+	user User
+}
+
+func (s oneUserStore) Get(_ context.Context, id int, _ bool) (User, error) {
+	if id != s.user.ID {
+		return User{}, ErrUserNotFound
+	}
+	return s.user, nil
+}
+
+func TestHeadUserMatchesGetHeaders(t *testing.T) {
+	user := User{ID: 1, Name: "Ada", CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	app := &App{store: oneUserStore{user: user}, queryTimeout: time.Second}
+	serve := func(method string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, usersPath+"/1", nil)
+		r.SetPathValue("id", "1")
+		w := httptest.NewRecorder()
+		if method == http.MethodHead {
+			app.handleHeadUser(w, r)
+		} else {
+			app.handleGetUser(w, r)
+		}
+		return w
+	}
+
+	get, head := serve(http.MethodGet), serve(http.MethodHead)
+	if head.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", head.Code, http.StatusOK)
+	}
+	if want := strconv.Itoa(get.Body.Len()); head.Header().Get("Content-Length") != want {
+		t.Errorf("Content-Length = %q, want %s", head.Header().Get("Content-Length"), want)
+	}
+	for _, key := range []string{"Content-Type", "ETag"} {
+		if head.Header().Get(key) != get.Header().Get(key) {
+			t.Errorf("%s = %q, want %q as for GET", key, head.Header().Get(key), get.Header().Get(key))
+		}
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	user := User{ID: 1, Name: "Ada"}
+	tests := []struct {
+		name   string
+		id     string
+		status int
+		want   string
+	}{
+		{name: "found", id: "1", status: http.StatusOK, want: `"name":"Ada"`},
+		{name: "unknown id", id: "2", status: http.StatusNotFound, want: `"error":"user not found"`},
+		{name: "invalid id", id: "abc", status: http.StatusBadRequest, want: `"error":"Invalid user id"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{store: oneUserStore{user: user}, queryTimeout: time.Second}
+			r := httptest.NewRequest(http.MethodGet, usersPath+"/"+tt.id, nil)
+			r.SetPathValue("id", tt.id)
+			w := httptest.NewRecorder()
+			app.handleGetUser(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if body := w.Body.String(); !strings.Contains(body, tt.want) {
+				t.Errorf("body = %s, want it to contain %s", body, tt.want)
+			}
+		})
+	}
+}
+
+// takenNameStore reports name as taken and every email as free.
+type takenNameStore struct {
+	UserStore
+	name string
+}
+
+func (s takenNameStore) NameExists(_ context.Context, name string) (bool, error) {
+	return name == s.name, nil
+}
+
+func (s takenNameStore) EmailExists(context.Context, string) (bool, error) {
+	return false, nil
+}
+
+func TestAddUserValidateOnly(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   []FieldError
+	}{
+		{name: "valid", body: `{"name":"Grace"}`, status: http.StatusNoContent},
+		{
+			name: "taken name", body: `{"name":"Ada"}`, status: http.StatusUnprocessableEntity,
+			want: []FieldError{{Field: "name", Message: "Name already exists"}},
+		},
+		{
+			name: "invalid fields", body: `{"name":" ","email":"nope"}`, status: http.StatusUnprocessableEntity,
+			want: []FieldError{
+				{Field: "name", Message: "Name is required"},
+				{Field: "email", Message: "Email must be a valid address"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &App{
+				store: takenNameStore{name: "Ada"}, queryTimeout: time.Second, maxNameLength: defaultMaxNameLength,
+				jsonLimits: jsonLimits{maxDepth: defaultJSONMaxDepth, maxElements: defaultJSONMaxElements},
+			}
+			r := httptest.NewRequest(http.MethodPost, usersPath+"?validate=true", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			app.handleAddUser(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.want == nil {
+				return
+			}
+			var got ValidationError
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body %q is not a ValidationError: %v", w.Body.String(), err)
+			}
+			if !slices.Equal(got.Errors, tt.want) {
+				t.Errorf("errors = %+v, want %+v", got.Errors, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	auditPath = "/api/audit"
+
+	auditActionCreate  = "create"
+	auditActionUpdate  = "update"
+	auditActionDelete  = "delete"
+	auditActionRestore = "restore"
+	auditActionReset   = "reset"
+)
+
+// AuditEntry records one mutation of a user, with the user as JSON before
+// and after it. Before is empty for creates and After for resets.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Action    string          `json:"action"`
+	UserID    *int            `json:"user_id"`
+	Actor     string          `json:"actor"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type AuditParams struct {
+	Limit  int
+	Offset int
+	// UserID only returns entries about that user when set.
+	UserID *int
+}
+
+// actorFromContext names who is making the request: the subject of its
+// bearer token, or anonymous when JWT authentication is off.
+func actorFromContext(ctx context.Context) string {
+	if claims, ok := claimsFromContext(ctx); ok && claims.Subject != "" {
+		return claims.Subject
+	}
+	return "anonymous"
+}
+
+func marshalAuditValue(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// writeAudit records action in tx, so the entry commits or rolls back
+// together with the change it describes.
+func writeAudit(ctx context.Context, tx pgx.Tx, action string, userID *int, before, after any) error {
+	beforeJSON, err := marshalAuditValue(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := marshalAuditValue(after)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO audit_log (action, user_id, actor, before, after) VALUES ($1, $2, $3, $4, $5)",
+		action, userID, actorFromContext(ctx), beforeJSON, afterJSON,
+	)
+	return err
+}
+
+// auditUserChange records a mutation of a single user.
+func auditUserChange(ctx context.Context, tx pgx.Tx, action string, before, after *User) error {
+	var id int
+	var beforeValue, afterValue any
+	if before != nil {
+		id, beforeValue = before.ID, before
+	}
+	if after != nil {
+		id, afterValue = after.ID, after
+	}
+	return writeAudit(ctx, tx, action, &id, beforeValue, afterValue)
+}
+
+func (s *pgUserStore) ListAudit(ctx context.Context, params AuditParams) ([]AuditEntry, error) {
+	query := "SELECT id, action, user_id, actor, before, after, created_at FROM audit_log"
+	var args []any
+	if params.UserID != nil {
+		args = append(args, *params.UserID)
+		query += " WHERE user_id = $1"
+	}
+	args = append(args, params.Limit, params.Offset)
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	entries := make([]AuditEntry, 0)
+	err := s.run(ctx, true, func() error {
+		entries = entries[:0]
+		rows, err := s.readDB.Query(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var e AuditEntry
+			var before, after []byte
+			if err := rows.Scan(&e.ID, &e.Action, &e.UserID, &e.Actor, &before, &after, &e.CreatedAt); err != nil {
+				return err
+			}
+			e.Before, e.After = before, after
+			entries = append(entries, e)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type GetAuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
+// handleGetAudit lists audit entries, newest first.
+func (app *App) handleGetAudit(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseQueryInt(r, "limit", defaultUsersLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset, err := parseQueryInt(r, "offset", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	params := AuditParams{Limit: min(limit, maxUsersLimit), Offset: offset}
+	if r.URL.Query().Has("user_id") {
+		userID, err := parseQueryInt(r, "user_id", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params.UserID = &userID
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	entries, err := app.store.ListAudit(ctx, params)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to list audit entries", "Error listing audit entries")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, GetAuditResponse{Entries: entries})
+}
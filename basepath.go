@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	BasePathEnvKey        = "BASE_PATH"
+	BasePathExemptEnvKey  = "BASE_PATH_EXEMPT"
+	defaultBasePathExempt = "/_internal/,/metrics"
+)
+
+type basePathKey struct{}
+
+// trimBasePath removes base from p, which must be base itself or have base
+// as its leading path segments, so /svc does not match /svcx/.
+func trimBasePath(p, base string) (string, bool) {
+	if p == base {
+		return "/", true
+	}
+	if rest, ok := strings.CutPrefix(p, base); ok && strings.HasPrefix(rest, "/") {
+		return rest, true
+	}
+	return "", false
+}
+
+// stripBasePath serves requests under basePath with the prefix removed, so
+// routes are registered without it. Paths starting with one of exempt are
+// also served without the prefix, which keeps probes that bypass the
+// ingress working. Anything else is a 404. It is a no-op when basePath is
+// empty.
+func stripBasePath(basePath string, exempt []string) middleware {
+	return func(next http.Handler) http.Handler {
+		if basePath == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rest, ok := trimBasePath(r.URL.Path, basePath)
+			if !ok {
+				if hasAnyPrefix(r.URL.Path, exempt) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				writeError(w, http.StatusNotFound, "Not found")
+				return
+			}
+
+			u := new(url.URL)
+			*u = *r.URL
+			u.Path = rest
+			// RawPath is only set when it differs from the escaped Path; if the
+			// prefix can't be cut from it cleanly, Path alone is authoritative.
+			u.RawPath, _ = trimBasePath(r.URL.RawPath, basePath)
+			r2 := r.WithContext(context.WithValue(r.Context(), basePathKey{}, basePath))
+			r2.URL = u
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// externalPath prefixes p with the base path r was received under, for
+// URLs handed back to clients such as Location headers.
+func externalPath(r *http.Request, p string) string {
+	base, _ := r.Context().Value(basePathKey{}).(string)
+	return base + p
+}
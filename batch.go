@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type BatchAddUsersRequest struct {
+	Users []AddUserRequest `json:"users"`
+}
+
+type BatchAddUsersResponse struct {
+	Users []UserResponse `json:"users"`
+}
+
+// startsWithArray reports whether the first non-whitespace byte of br
+// opens a JSON array, consuming only the whitespace before it.
+func startsWithArray(br *bufio.Reader) bool {
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		_ = br.UnreadByte()
+		return c == '['
+	}
+}
+
+func (app *App) handleBatchAddUsers(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	// Accept a bare array of users as well as the {"users": [...]} object.
+	body := bufio.NewReader(r.Body)
+	r.Body = readCloser{body, r.Body}
+	var req BatchAddUsersRequest
+	var dst any = &req
+	if startsWithArray(body) {
+		dst = &req.Users
+	}
+	if err := decodeJSON(r, dst, app.jsonLimits); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	if len(req.Users) == 0 {
+		writeError(w, http.StatusBadRequest, "At least one user is required")
+		return
+	}
+	if len(req.Users) > app.maxBatchSize {
+		writeError(
+			w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Batch size %d exceeds the maximum of %d", len(req.Users), app.maxBatchSize),
+		)
+		return
+	}
+	newUsers := make([]NewUser, len(req.Users))
+	var verr ValidationError
+	for i, user := range req.Users {
+		newUser, err := validateNewUser(user, app.maxNameLength)
+		var userErr *ValidationError
+		if errors.As(err, &userErr) {
+			for _, fe := range userErr.Errors {
+				fe.Field = fmt.Sprintf("users[%d].%s", i, fe.Field)
+				verr.Errors = append(verr.Errors, fe)
+			}
+		}
+		newUsers[i] = newUser
+	}
+	if err := verr.errOrNil(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	users, err := app.store.CreateBatch(ctx, newUsers)
+	if errors.Is(err, ErrNameExists) {
+		writeError(w, http.StatusConflict, "name already exists")
+		return
+	}
+	if errors.Is(err, ErrNameTooLong) {
+		writeError(w, http.StatusBadRequest, "name is too long")
+		return
+	}
+	if errors.Is(err, ErrEmailExists) {
+		writeError(w, http.StatusConflict, "email already exists")
+		return
+	}
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to add users to database", "Error inserting users")
+		return
+	}
+
+	response := BatchAddUsersResponse{Users: make([]UserResponse, len(users))}
+	for i, user := range users {
+		response.Users[i] = UserResponse(user)
+	}
+
+	writeJSON(w, http.StatusCreated, response)
+}
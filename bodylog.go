@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	LogBodiesEnvKey          = "LOG_BODIES"
+	LogBodiesMaxBytesEnvKey  = "LOG_BODIES_MAX_BYTES"
+	LogRedactKeysEnvKey      = "LOG_REDACT_KEYS"
+	defaultLogBodiesMaxBytes = 4096
+	defaultLogRedactKeys     = "password,token,secret,api_key,authorization,email"
+	redacted                 = "[REDACTED]"
+)
+
+// bodyCapture keeps the first max bytes written through it.
+type bodyCapture struct {
+	http.ResponseWriter
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	room := c.max - c.buf.Len()
+	if len(p) > room {
+		c.truncated = true
+	}
+	if room > 0 {
+		c.buf.Write(p[:min(len(p), room)])
+	}
+	return c.ResponseWriter.Write(p)
+}
+
+func (c *bodyCapture) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// logBodies logs request and response bodies of up to maxBytes each, for
+// debugging client integrations. Values under any of redactKeys are
+// replaced in JSON bodies; a body that can't be parsed, such as one cut
+// off at maxBytes, is only logged when it mentions none of them.
+// Streaming responses are skipped.
+func logBodies(enabled bool, maxBytes int, redactKeys []string, isStreaming func(*http.Request) bool) middleware {
+	keys := make(map[string]bool, len(redactKeys))
+	for _, k := range redactKeys {
+		keys[strings.ToLower(k)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isStreaming(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var reqBody []byte
+			reqTruncated := false
+			if r.Body != nil && r.Body != http.NoBody {
+				// Only the logged prefix is buffered; the handler reads it
+				// back followed by the rest of the original body, so size
+				// limits and read errors still reach it unchanged.
+				reqBody, _ = io.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+				if len(reqBody) > maxBytes {
+					reqTruncated = true
+				}
+				r.Body = readCloser{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+				reqBody = reqBody[:min(len(reqBody), maxBytes)]
+			}
+
+			capture := &bodyCapture{ResponseWriter: w, max: maxBytes}
+			next.ServeHTTP(capture, r)
+
+			logger.InfoContext(
+				r.Context(), "Request bodies",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"request_body", redactBody(reqBody, reqTruncated, keys),
+				"response_body", redactBody(capture.buf.Bytes(), capture.truncated, keys),
+			)
+		})
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// redactBody returns body ready to log: parsed JSON with the values of keys
+// replaced, or the raw text when it is not JSON and safe to log as is.
+func redactBody(body []byte, truncated bool, keys map[string]bool) any {
+	if len(body) == 0 {
+		return nil
+	}
+	if !truncated {
+		var v any
+		if err := json.Unmarshal(body, &v); err == nil {
+			return redactValue(v, keys)
+		}
+	}
+	lower := strings.ToLower(string(body))
+	for k := range keys {
+		if strings.Contains(lower, k) {
+			return redacted
+		}
+	}
+	if truncated {
+		return string(body) + "...[truncated]"
+	}
+	return string(body)
+}
+
+func redactValue(v any, keys map[string]bool) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, val := range v {
+			if keys[strings.ToLower(k)] {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(val, keys)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = redactValue(val, keys)
+		}
+	}
+	return v
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sony/gobreaker"
+)
+
+const (
+	DbBreakerFailuresEnvKey     = "DB_BREAKER_FAILURES"
+	DbBreakerOpenTimeoutEnvKey  = "DB_BREAKER_OPEN_TIMEOUT"
+	DbBreakerProbesEnvKey       = "DB_BREAKER_PROBES"
+	defaultDbBreakerFailures    = 5
+	defaultDbBreakerOpenTimeout = 10 * time.Second
+	defaultDbBreakerProbes      = 1
+	dbBreakerName               = "postgres"
+)
+
+// newDBBreaker returns a breaker that opens after failures consecutive
+// failed store calls, fails fast for openTimeout, then lets probes calls
+// through to decide whether to close again.
+func newDBBreaker(failures, probes int, openTimeout time.Duration) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:        dbBreakerName,
+		MaxRequests: uint32(probes),
+		Timeout:     openTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= uint32(failures)
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			logger.Warn("Circuit breaker changed state", "breaker", name, "from", from.String(), "to", to.String())
+		},
+		IsSuccessful: func(err error) bool {
+			return !isDBFailure(err)
+		},
+	})
+}
+
+// isDBFailure reports whether err says the database is unwell, as opposed
+// to the request being wrong or the client going away. Timeouts count,
+// since an overloaded database shows up as slow queries first.
+func isDBFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	return errors.Is(err, context.DeadlineExceeded) || isRetryable(err, true)
+}
+
+// isBreakerOpen reports whether err is the breaker refusing a call.
+func isBreakerOpen(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+)
+
+type BulkDeleteUsersRequest struct {
+	IDs []int `json:"ids"`
+}
+
+type BulkDeleteUsersResponse struct {
+	// Requested counts the distinct IDs in the request.
+	Requested int `json:"requested"`
+	Deleted   int `json:"deleted"`
+	// NotFound lists the requested IDs that matched no live user, so were
+	// left alone.
+	NotFound []int `json:"not_found"`
+}
+
+// handleBulkDeleteUsers soft-deletes a list of users at once. Either all of
+// the live users among them are deleted or none are.
+func (app *App) handleBulkDeleteUsers(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	var req BulkDeleteUsersRequest
+	if err := decodeJSON(r, &req, app.jsonLimits); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	ids := slices.Compact(slices.Sorted(slices.Values(req.IDs)))
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, "At least one id is required")
+		return
+	}
+	if len(ids) > app.maxBatchSize {
+		writeError(
+			w, http.StatusBadRequest,
+			fmt.Sprintf("%d ids exceed the maximum of %d", len(ids), app.maxBatchSize),
+		)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	deleted, err := app.store.DeleteMany(ctx, ids)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to delete users from database", "Error deleting users")
+		return
+	}
+
+	notFound := make([]int, 0, len(ids)-len(deleted))
+	for _, id := range ids {
+		if !slices.Contains(deleted, id) {
+			notFound = append(notFound, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, BulkDeleteUsersResponse{
+		Requested: len(ids),
+		Deleted:   len(deleted),
+		NotFound:  notFound,
+	})
+}
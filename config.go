@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Config holds every setting read from the environment.
+type Config struct {
+	Port     string
+	BindAddr string
+	// InternalPort, when set, serves the health, metrics and debug
+	// endpoints on a separate server instead of the public port.
+	InternalPort string
+	// BasePath is the prefix every route is served under, such as
+	// /users-svc, without a trailing slash; "" serves routes at the root.
+	BasePath       string
+	BasePathExempt []string
+
+	// DatabaseURL is used verbatim, including its sslmode, when it is set;
+	// otherwise the connection string is built from the Db* fields.
+	DatabaseURL string
+	// DbReplicaURL, when set, points reads at a replica.
+	DbReplicaURL     string
+	DbUser           string
+	DbPassword       string
+	DbHost           string
+	DbPort           string
+	DbName           string
+	DbSSLMode        string
+	DbMaxConns       int
+	DbMinConns       int
+	DbConnectRetries int
+	DbQueryRetries   int
+	// The circuit breaker opens after DbBreakerFailures consecutive failed
+	// store calls and lets DbBreakerProbes calls through once
+	// DbBreakerOpenTimeout has passed.
+	DbBreakerFailures    int
+	DbBreakerProbes      int
+	DbBreakerOpenTimeout time.Duration
+	DbTxIsolation        pgx.TxIsoLevel
+	// DbQueryExecMode is a key of queryExecModes, or "" to keep the pgx
+	// default or the connection string's default_query_exec_mode.
+	DbQueryExecMode    string
+	DbAppName          string
+	DbQueryTimeout     time.Duration
+	DbConnectTimeout   time.Duration
+	DbPingTimeout      time.Duration
+	DbLatencyThreshold time.Duration
+	// SlowQueryThreshold is the duration above which a statement is logged.
+	SlowQueryThreshold time.Duration
+	HealthQuery        string
+	DbMaxConnLifetime  time.Duration
+	DbMaxConnIdleTime  time.Duration
+
+	ShutdownTimeout       time.Duration
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	MaxBodyBytes          int
+	JSONMaxDepth          int
+	JSONMaxElements       int
+	RequestTimeout        time.Duration
+	TLSCertFile           string
+	TLSKeyFile            string
+
+	BatchMaxSize      int
+	LookupMaxIDs      int
+	MaxNameLength     int
+	IdempotencyKeyTTL time.Duration
+	AllowReset        bool
+
+	LogLevel           slog.Level
+	EnablePprof        bool
+	AllowedOrigins     []string
+	CORSAllowedHeaders []string
+	CORSMaxAge         time.Duration
+	APIKeys            []string
+	SecurityHeaders    bool
+	HSTSMaxAge         time.Duration
+	RateLimitRPS       int
+	RateLimitBurst     int
+	TrustProxy         bool
+	JWTSecret          string
+	JWTJWKSURL         string
+	JWTIssuer          string
+	JWTAudience        string
+
+	LogBodies         bool
+	LogBodiesMaxBytes int
+	LogRedactKeys     []string
+}
+
+// queryExecModes maps DB_QUERY_EXEC_MODE values to pgx modes, using the
+// names pgx accepts for default_query_exec_mode. Behind PgBouncer in
+// transaction pooling mode, use exec or simple_protocol.
+var queryExecModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+// ConfigError lists every problem found while loading the config.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// envReader reads typed env values, recording a problem instead of
+// failing on the first bad one.
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) addf(format string, args ...any) {
+	e.problems = append(e.problems, fmt.Sprintf(format, args...))
+}
+
+func (e *envReader) string(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// int reads a positive integer.
+func (e *envReader) int(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v <= 0 {
+		e.addf("%s must be a positive integer, got %q", key, raw)
+		return def
+	}
+	return v
+}
+
+// nonNegativeInt is int for settings where 0 turns a feature off.
+func (e *envReader) nonNegativeInt(key string, def int) int {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		e.addf("%s must be a non-negative integer, got %q", key, raw)
+		return def
+	}
+	return v
+}
+
+// duration reads a positive duration such as 500ms or 1m30s.
+func (e *envReader) duration(key string, def time.Duration) time.Duration {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		e.addf("%s must be a positive duration such as 5s, got %q", key, raw)
+		return def
+	}
+	return d
+}
+
+func (e *envReader) bool(key string, def bool) bool {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return def
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		e.addf("%s must be true or false, got %q", key, raw)
+		return def
+	}
+	return v
+}
+
+func (e *envReader) port(key, def string) string {
+	raw := e.string(key, def)
+	if p, err := strconv.Atoi(raw); err != nil || p < 1 || p > 65535 {
+		e.addf("%s must be a port number between 1 and 65535, got %q", key, raw)
+	}
+	return raw
+}
+
+func (e *envReader) oneOf(key, def string, allowed ...string) string {
+	raw := e.string(key, def)
+	for _, v := range allowed {
+		if strings.EqualFold(raw, v) {
+			return v
+		}
+	}
+	e.addf("%s must be one of %s, got %q", key, strings.Join(allowed, ", "), raw)
+	return def
+}
+
+// LoadConfig reads the config from the environment and applies defaults.
+// The returned *ConfigError lists every invalid value at once.
+func LoadConfig() (*Config, error) {
+	var e envReader
+	cfg := &Config{
+		Port:           e.port(AppPortEnvKey, "8080"),
+		BindAddr:       os.Getenv(BindAddrEnvKey),
+		BasePath:       strings.TrimRight(os.Getenv(BasePathEnvKey), "/"),
+		BasePathExempt: splitList(e.string(BasePathExemptEnvKey, defaultBasePathExempt)),
+
+		DatabaseURL:  os.Getenv(DatabaseURLEnvKey),
+		DbReplicaURL: os.Getenv(DbReplicaURLEnvKey),
+		DbUser:       e.string(DbUserEnvKey, "postgres"),
+		DbPassword:   os.Getenv(DbPasswordEnvKey),
+		DbHost:       e.string(DbHostEnvKey, "localhost"),
+		DbPort:       e.port(DbPortEnvKey, "5432"),
+		DbName:       e.string(DbNameEnvKey, "postgres"),
+		DbSSLMode: e.oneOf(
+			DbSSLModeEnvKey, "disable",
+			"disable", "allow", "prefer", "require", "verify-ca", "verify-full",
+		),
+		DbMaxConns:           e.int(DbMaxConnsEnvKey, defaultDbMaxConns),
+		DbMinConns:           e.int(DbMinConnsEnvKey, defaultDbMinConns),
+		DbConnectRetries:     e.int(DbConnectRetriesEnvKey, defaultDbConnectRetries),
+		DbAppName:            os.Getenv(DbAppNameEnvKey),
+		DbQueryRetries:       e.nonNegativeInt(DbQueryRetriesEnvKey, defaultDbQueryRetries),
+		DbBreakerFailures:    e.int(DbBreakerFailuresEnvKey, defaultDbBreakerFailures),
+		DbBreakerProbes:      e.int(DbBreakerProbesEnvKey, defaultDbBreakerProbes),
+		DbBreakerOpenTimeout: e.duration(DbBreakerOpenTimeoutEnvKey, defaultDbBreakerOpenTimeout),
+		DbTxIsolation: pgx.TxIsoLevel(e.oneOf(
+			DbTxIsolationEnvKey, string(pgx.ReadCommitted),
+			string(pgx.ReadCommitted), string(pgx.RepeatableRead), string(pgx.Serializable),
+		)),
+		DbQueryTimeout:     e.duration(DbQueryTimeoutEnvKey, defaultDbQueryTimeout),
+		DbConnectTimeout:   e.duration(DbConnectTimeoutEnvKey, defaultDbConnectTimeout),
+		DbPingTimeout:      e.duration(DbPingTimeoutEnvKey, defaultDbPingTimeout),
+		DbLatencyThreshold: e.duration(DbLatencyThresholdEnvKey, defaultDbLatencyThreshold),
+		SlowQueryThreshold: e.duration(SlowQueryThresholdEnvKey, defaultSlowQueryThreshold),
+		HealthQuery:        e.string(HealthQueryEnvKey, defaultHealthQuery),
+		DbMaxConnLifetime:  e.duration(DbMaxConnLifetimeEnvKey, defaultDbMaxConnLifetime),
+		DbMaxConnIdleTime:  e.duration(DbMaxConnIdleTimeEnvKey, defaultDbMaxConnIdleTime),
+
+		ShutdownTimeout:       e.duration(ShutdownTimeoutEnvKey, defaultShutdownTimeout),
+		HTTPReadHeaderTimeout: e.duration(HTTPReadHeaderTimeoutEnvKey, defaultHTTPReadHeaderTimeout),
+		HTTPReadTimeout:       e.duration(HTTPReadTimeoutEnvKey, defaultHTTPReadTimeout),
+		HTTPWriteTimeout:      e.duration(HTTPWriteTimeoutEnvKey, defaultHTTPWriteTimeout),
+		HTTPIdleTimeout:       e.duration(HTTPIdleTimeoutEnvKey, defaultHTTPIdleTimeout),
+		MaxBodyBytes:          e.int(MaxBodyBytesEnvKey, defaultMaxBodyBytes),
+		JSONMaxDepth:          e.int(JSONMaxDepthEnvKey, defaultJSONMaxDepth),
+		JSONMaxElements:       e.int(JSONMaxElementsEnvKey, defaultJSONMaxElements),
+		RequestTimeout:        e.duration(RequestTimeoutEnvKey, defaultRequestTimeout),
+		TLSCertFile:           os.Getenv(TLSCertFileEnvKey),
+		TLSKeyFile:            os.Getenv(TLSKeyFileEnvKey),
+
+		BatchMaxSize:      e.int(BatchMaxSizeEnvKey, defaultBatchMaxSize),
+		LookupMaxIDs:      e.int(LookupMaxIDsEnvKey, defaultLookupMaxIDs),
+		MaxNameLength:     e.int(MaxNameLengthEnvKey, defaultMaxNameLength),
+		IdempotencyKeyTTL: e.duration(IdempotencyKeyTTLEnvKey, defaultIdempotencyKeyTTL),
+		AllowReset:        e.bool(AllowResetEnvKey, false),
+
+		EnablePprof:        e.bool(EnablePprofEnvKey, false),
+		AllowedOrigins:     splitList(os.Getenv(AllowedOriginsEnvKey)),
+		CORSAllowedHeaders: splitList(e.string(CORSAllowedHeadersEnvKey, defaultCORSAllowedHeaders)),
+		CORSMaxAge:         e.duration(CORSMaxAgeEnvKey, defaultCORSMaxAge),
+		APIKeys:            splitList(os.Getenv(APIKeyEnvKey)),
+		SecurityHeaders:    e.bool(SecurityHeadersEnvKey, true),
+		HSTSMaxAge:         e.duration(HSTSMaxAgeEnvKey, defaultHSTSMaxAge),
+		RateLimitRPS:       e.nonNegativeInt(RateLimitRPSEnvKey, defaultRateLimitRPS),
+		RateLimitBurst:     e.int(RateLimitBurstEnvKey, defaultRateLimitBurst),
+		TrustProxy:         e.bool(TrustProxyEnvKey, false),
+		JWTSecret:          os.Getenv(JWTSecretEnvKey),
+		JWTJWKSURL:         os.Getenv(JWTJWKSURLEnvKey),
+		JWTIssuer:          os.Getenv(JWTIssuerEnvKey),
+		JWTAudience:        os.Getenv(JWTAudienceEnvKey),
+
+		LogBodies:         e.bool(LogBodiesEnvKey, false),
+		LogBodiesMaxBytes: e.int(LogBodiesMaxBytesEnvKey, defaultLogBodiesMaxBytes),
+		LogRedactKeys:     splitList(e.string(LogRedactKeysEnvKey, defaultLogRedactKeys)),
+	}
+
+	if raw := os.Getenv(LogLevelEnvKey); raw != "" {
+		if err := cfg.LogLevel.UnmarshalText([]byte(strings.ToUpper(raw))); err != nil {
+			e.addf("%s must be one of debug, info, warn, error, got %q", LogLevelEnvKey, raw)
+		}
+	}
+	if raw := os.Getenv(DbQueryExecModeEnvKey); raw != "" {
+		if _, ok := queryExecModes[strings.ToLower(raw)]; ok {
+			cfg.DbQueryExecMode = strings.ToLower(raw)
+		} else {
+			e.addf(
+				"%s must be one of cache_statement, cache_describe, describe_exec, exec, simple_protocol, got %q",
+				DbQueryExecModeEnvKey, raw,
+			)
+		}
+	}
+	if os.Getenv(InternalPortEnvKey) != "" {
+		cfg.InternalPort = e.port(InternalPortEnvKey, "")
+		if cfg.InternalPort == cfg.Port {
+			e.addf("%s must differ from %s", InternalPortEnvKey, AppPortEnvKey)
+		}
+	}
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		e.addf("%s must start with /, got %q", BasePathEnvKey, os.Getenv(BasePathEnvKey))
+	}
+	// An empty password fails with a confusing auth error or, worse, connects
+	// to a trust-auth database nobody meant to use. DATABASE_URL is exempt
+	// since the password may come from the URL or a passfile.
+	if cfg.DatabaseURL == "" && cfg.DbPassword == "" && !e.bool(AllowEmptyDbPasswordEnvKey, false) {
+		e.addf("%s is empty; set %s=true to allow it for local trust-auth databases", DbPasswordEnvKey, AllowEmptyDbPasswordEnvKey)
+	}
+	if cfg.DbMinConns > cfg.DbMaxConns {
+		e.addf(
+			"%s (%d) must not be greater than %s (%d)",
+			DbMinConnsEnvKey, cfg.DbMinConns, DbMaxConnsEnvKey, cfg.DbMaxConns,
+		)
+	}
+	// The users_name_length check constraint caps names at 255 in the
+	// database, so a higher limit would let through names it then rejects.
+	if cfg.MaxNameLength > maxNameLengthLimit {
+		e.addf("%s must be at most %d, got %d", MaxNameLengthEnvKey, maxNameLengthLimit, cfg.MaxNameLength)
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		e.addf("%s and %s must be set together", TLSCertFileEnvKey, TLSKeyFileEnvKey)
+	}
+
+	if len(e.problems) > 0 {
+		return nil, &ConfigError{Problems: e.problems}
+	}
+	return cfg, nil
+}
+
+// connString returns DatabaseURL when set, or builds a connection string
+// from the individual DB settings.
+func (cfg *Config) connString() string {
+	if cfg.DatabaseURL != "" {
+		return cfg.DatabaseURL
+	}
+	return fmt.Sprintf(
+		"postgres://%s:%s@%s:%s/%s?sslmode=%s",
+		cfg.DbUser, cfg.DbPassword, cfg.DbHost, cfg.DbPort, cfg.DbName, cfg.DbSSLMode,
+	)
+}
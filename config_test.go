@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestLoadConfigQueryRetries(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    int
+		wantErr bool
+	}{
+		{raw: "", want: defaultDbQueryRetries},
+		{raw: "0", want: 0},
+		{raw: "3", want: 3},
+		{raw: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			t.Setenv(DbPasswordEnvKey, "secret")
+			t.Setenv(DbQueryRetriesEnvKey, tt.raw)
+
+			cfg, err := LoadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("LoadConfig accepted %s=%q", DbQueryRetriesEnvKey, tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if cfg.DbQueryRetries != tt.want {
+				t.Errorf("DbQueryRetries = %d, want %d", cfg.DbQueryRetries, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	JSONMaxDepthEnvKey     = "JSON_MAX_DEPTH"
+	JSONMaxElementsEnvKey  = "JSON_MAX_ELEMENTS"
+	defaultJSONMaxDepth    = 32
+	defaultJSONMaxElements = 10000
+)
+
+var (
+	errTrailingData         = errors.New("request body must contain a single JSON value")
+	errEmptyBody            = errors.New("request body required")
+	errUnsupportedMediaType = errors.New("content type must be application/json")
+)
+
+// jsonLimits bound the shape of a request body, on top of the byte limit,
+// since a small body can still decode into a huge number of values.
+type jsonLimits struct {
+	maxDepth    int
+	maxElements int
+}
+
+// jsonLimitError reports a body that went over one of the jsonLimits.
+type jsonLimitError struct {
+	message string
+}
+
+func (e *jsonLimitError) Error() string {
+	return e.message
+}
+
+// check walks the tokens of body without decoding any values, so oversized
+// payloads are refused before anything is allocated for them. Syntax errors
+// are left for the decoder to report.
+func (l jsonLimits) check(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// Each entry is true for an array and false for an object.
+	var stack []bool
+	elements := 0
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		if len(stack) > 0 && stack[len(stack)-1] && tok != json.Delim(']') {
+			elements++
+			if elements > l.maxElements {
+				return &jsonLimitError{fmt.Sprintf("Request body must not contain more than %d array elements", l.maxElements)}
+			}
+		}
+		switch tok {
+		case json.Delim('['), json.Delim('{'):
+			stack = append(stack, tok == json.Delim('['))
+			if len(stack) > l.maxDepth {
+				return &jsonLimitError{fmt.Sprintf("Request body must not nest deeper than %d levels", l.maxDepth)}
+			}
+		case json.Delim(']'), json.Delim('}'):
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+// decodeJSON decodes the request body into dst, which must be a non-nil
+// pointer, rejecting unknown fields and anything that follows the first JSON
+// value. An empty body or a literal null is errEmptyBody, a body sent with
+// any Content-Type other than application/json is errUnsupportedMediaType,
+// and one over limits is a *jsonLimitError.
+func decodeJSON(r *http.Request, dst any, limits jsonLimits) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	// Check for an empty body first: clients that send none usually send
+	// no Content-Type either.
+	if len(bytes.TrimSpace(body)) == 0 {
+		return errEmptyBody
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return errUnsupportedMediaType
+	}
+	if err := limits.check(body); err != nil {
+		return err
+	}
+
+	// Decoding through a pointer to dst lets json report a null body by
+	// setting that pointer to nil.
+	holder := reflect.New(reflect.TypeOf(dst))
+	holder.Elem().Set(reflect.ValueOf(dst))
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(holder.Interface()); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field == "" {
+			typeErr.Field = typeErrorField(body, dst)
+		}
+		return err
+	}
+	if holder.Elem().IsNil() {
+		return errEmptyBody
+	}
+	if err := decoder.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errTrailingData
+	}
+	return nil
+}
+
+// typeErrorField names the top-level field of body that failed to decode
+// into dst. encoding/json leaves Field empty for errors from custom
+// unmarshalers such as Optional, so each field is decoded again on its own
+// to find the culprit.
+func typeErrorField(body []byte, dst any) string {
+	t := reflect.TypeOf(dst).Elem()
+	if t.Kind() != reflect.Struct {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return ""
+	}
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" {
+			name = field.Name
+		}
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(json.Unmarshal(raw, reflect.New(field.Type).Interface()), &typeErr) {
+			return name
+		}
+	}
+	return ""
+}
+
+// jsonTypeName describes the JSON type that decodes into t.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	default:
+		return "an object"
+	}
+}
+
+// decodeErrorMessage turns an error from decodeJSON into a message that
+// tells the client what is wrong with the payload.
+func decodeErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("Malformed JSON at position %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "Malformed JSON"
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			// The body itself has the wrong type, such as an array for an
+			// object.
+			return fmt.Sprintf("Invalid value: expected %s", jsonTypeName(typeErr.Type))
+		}
+		return fmt.Sprintf("field '%s' must be %s", typeErr.Field, jsonTypeName(typeErr.Type))
+	case errors.Is(err, errEmptyBody):
+		return "Request body required"
+	case errors.Is(err, errTrailingData):
+		return "Request body must contain a single JSON value"
+	}
+	// encoding/json has no error type for unknown fields.
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return fmt.Sprintf("unknown field '%s'", strings.Trim(field, `"`))
+	}
+	return "Invalid request payload"
+}
+
+// writeDecodeError responds to a request body that could not be decoded,
+// using 413 when the body went over the size or shape limits and 415 when
+// it is not JSON.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.WarnContext(r.Context(), "Error decoding request body", "error", err)
+
+	if errors.Is(err, errUnsupportedMediaType) {
+		w.Header().Set("Accept", "application/json")
+		writeError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+		return
+	}
+
+	var limitErr *jsonLimitError
+	if errors.As(err, &limitErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, limitErr.message)
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(
+			w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit),
+		)
+		return
+	}
+	writeError(w, http.StatusBadRequest, decodeErrorMessage(err))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeErrorMessageNamesField(t *testing.T) {
+	limits := jsonLimits{maxDepth: defaultJSONMaxDepth, maxElements: defaultJSONMaxElements}
+	tests := []struct {
+		name string
+		dst  any
+		body string
+		want string
+	}{
+		{name: "PUT", dst: &UpdateUserRequest{}, body: `{"name":123}`, want: "field 'name' must be a string"},
+		{name: "PATCH", dst: &PatchUserRequest{}, body: `{"name":123}`, want: "field 'name' must be a string"},
+		{name: "wrong body type", dst: &PatchUserRequest{}, body: `[]`, want: "Invalid value: expected an object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, usersPath+"/1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			err := decodeJSON(r, tt.dst, limits)
+			if err == nil {
+				t.Fatal("decodeJSON succeeded, want a type error")
+			}
+			if got := decodeErrorMessage(err); got != tt.want {
+				t.Errorf("message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
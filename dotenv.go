@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+const (
+	EnvFileEnvKey  = "ENV_FILE"
+	defaultEnvFile = ".env"
+)
+
+// loadEnvFile sets variables from a .env style file of KEY=VALUE lines.
+// Variables already present in the environment win over the file. The
+// default .env is optional, but a file named by ENV_FILE must exist. It
+// returns the path it loaded, or "" when there was none.
+func loadEnvFile() (string, error) {
+	path, explicit := os.LookupEnv(EnvFileEnvKey)
+	if !explicit || path == "" {
+		path = defaultEnvFile
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return "", fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNo)
+		}
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		if err := os.Setenv(key, unquote(strings.TrimSpace(value))); err != nil {
+			return "", err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// unquote strips one pair of matching single or double quotes.
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
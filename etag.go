@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// userETag identifies a version of user. It is weak because the same
+// version can be sent pretty-printed or compressed.
+func userETag(user User) string {
+	h := sha256.New()
+	h.Write([]byte(strconv.Itoa(user.ID)))
+	h.Write([]byte{0})
+	h.Write([]byte(user.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(user.UpdatedAt.UnixMicro(), 10)))
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 requires for it.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ndjsonContentType  = "application/x-ndjson"
+	csvContentType     = "text/csv"
+	streamFlushEvery   = 500
+	streamWriteTimeout = 10 * time.Second
+)
+
+// accepts reports whether the Accept header lists mediaType explicitly.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// isStreamingRequest reports whether r is for one of the streaming
+// responses, which legitimately outlive normal request deadlines.
+func isStreamingRequest(r *http.Request) bool {
+	switch {
+	case r.URL.Path == usersPath+"/stream", strings.HasPrefix(r.URL.Path, "/debug/pprof/"):
+		return true
+	case r.URL.Path == usersPath:
+		return accepts(r, ndjsonContentType) || accepts(r, csvContentType)
+	default:
+		return false
+	}
+}
+
+// streamUsersNDJSON writes one JSON encoded user per line as rows are read,
+// so memory stays flat regardless of the result size. It runs without the
+// per-query timeout and pushes the write deadline forward on every flush,
+// since large exports legitimately take longer than a normal request.
+//
+// The 200 goes out with the first row, so a failure after that can't change
+// the status. The connection is aborted instead, so clients see an error
+// rather than a response that looks complete but is cut short.
+func (app *App) streamUsersNDJSON(w http.ResponseWriter, r *http.Request, params ListUsersParams) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	written := 0
+
+	err := app.store.Stream(ctx, params, func(user User) error {
+		if written == 0 {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		}
+		if err := encoder.Encode(user); err != nil {
+			return err
+		}
+		written++
+		if written%streamFlushEvery == 0 {
+			_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if written == 0 {
+			writeQueryError(ctx, w, err, "Failed to list users", "Error streaming users")
+		} else {
+			logQueryError(ctx, err, "Error streaming users")
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if written == 0 {
+		w.Header().Set("Content-Type", ndjsonContentType)
+	}
+	_ = rc.Flush()
+}
+
+// streamUsersCSV writes users as CSV with an id,name header row, streaming
+// rows and aborting on failure the same way streamUsersNDJSON does.
+// encoding/csv takes care of quoting names that contain commas, quotes or
+// newlines.
+func (app *App) streamUsersCSV(w http.ResponseWriter, r *http.Request, params ListUsersParams) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	cw := csv.NewWriter(w)
+	started := false
+	written := 0
+
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return cw.Write([]string{"id", "name"})
+	}
+
+	err := app.store.Stream(ctx, params, func(user User) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := cw.Write([]string{strconv.Itoa(user.ID), user.Name}); err != nil {
+			return err
+		}
+		written++
+		if written%streamFlushEvery == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			return rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if !started {
+			writeQueryError(ctx, w, err, "Failed to list users", "Error streaming users")
+		} else {
+			logQueryError(ctx, err, "Error streaming users")
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+	if !started {
+		if err := start(); err != nil {
+			logger.ErrorContext(ctx, "Error streaming users", "error", err)
+			return
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		logger.ErrorContext(ctx, "Error streaming users", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	_ = rc.Flush()
+}
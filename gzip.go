@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response body worth compressing; anything
+// shorter is sent as is.
+const gzipMinSize = 1024
+
+var gzipWriterPool = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// incompressibleTypes are content types that are already compressed.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/",
+	"application/gzip", "application/zip", "application/x-gzip", "application/zstd",
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+func compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return !hasAnyPrefix(mediaType, incompressibleTypes)
+}
+
+// gzipResponseWriter buffers the start of the body until it knows whether
+// the response is large enough to compress, then switches to either
+// compressing or passing writes through.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	decided bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.decided {
+		gw.buf = append(gw.buf, b...)
+		if len(gw.buf) < gzipMinSize {
+			return len(b), nil
+		}
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+func (gw *gzipResponseWriter) decide(large bool) error {
+	gw.decided = true
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+
+	if large && compressible(gw.Header()) {
+		gw.Header().Set("Content-Encoding", "gzip")
+		gw.Header().Del("Content-Length")
+		gw.gz = gzipWriterPool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := gw.Write(buf)
+	return err
+}
+
+// Flush commits to compression even below gzipMinSize, since a handler that
+// flushes is streaming and the total size is not known yet.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		_ = gw.decide(true)
+	}
+	if gw.gz != nil {
+		_ = gw.gz.Flush()
+	}
+	_ = http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+func (gw *gzipResponseWriter) finish() {
+	if !gw.decided {
+		_ = gw.decide(false)
+	}
+	if gw.gz != nil {
+		_ = gw.gz.Close()
+		gzipWriterPool.Put(gw.gz)
+		gw.gz = nil
+	}
+}
+
+func compress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
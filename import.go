@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type ImportUsersResponse struct {
+	Imported int64 `json:"imported"`
+}
+
+// readImportNames reads the name column of a CSV body. The header row must
+// name the columns, so a file produced by the CSV export can be imported
+// as is.
+func readImportNames(r io.Reader, maxNameLength int) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("CSV body is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	column := slices.IndexFunc(header, func(h string) bool {
+		return strings.EqualFold(strings.TrimSpace(h), "name")
+	})
+	if column < 0 {
+		return nil, errors.New("CSV header must include a name column")
+	}
+
+	var names []string
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+		if column >= len(record) {
+			return nil, fmt.Errorf("line %d: missing name column", line)
+		}
+		name, err := validateName(record[column], maxNameLength)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		names = append(names, name)
+	}
+}
+
+func (app *App) handleImportUsers(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	names, err := readImportNames(r.Body, app.maxNameLength)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(
+			w, http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit),
+		)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(names) == 0 {
+		writeError(w, http.StatusBadRequest, "At least one user is required")
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	n, err := app.store.BulkCreate(ctx, names)
+	if errors.Is(err, ErrNameExists) {
+		writeError(w, http.StatusConflict, "name already exists")
+		return
+	}
+	if errors.Is(err, ErrNameTooLong) {
+		writeError(w, http.StatusBadRequest, "name is too long")
+		return
+	}
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to import users", "Error importing users", "rows", len(names))
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, ImportUsersResponse{Imported: n})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// inFlightTracker counts the requests being served and remembers their
+// paths, so shutdown can report what is still draining.
+type inFlightTracker struct {
+	count atomic.Int64
+
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]string
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{requests: make(map[uint64]string)}
+}
+
+func (t *inFlightTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.count.Add(1)
+		t.mu.Lock()
+		id := t.nextID
+		t.nextID++
+		t.requests[id] = r.Method + " " + r.URL.Path
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			delete(t.requests, id)
+			t.mu.Unlock()
+			t.count.Add(-1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// paths returns the method and path of every request in flight, sorted.
+func (t *inFlightTracker) paths() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	paths := make([]string, 0, len(t.requests))
+	for _, p := range t.requests {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	return paths
+}
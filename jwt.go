@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	JWTSecretEnvKey     = "JWT_SECRET"
+	JWTJWKSURLEnvKey    = "JWT_JWKS_URL"
+	JWTIssuerEnvKey     = "JWT_ISSUER"
+	JWTAudienceEnvKey   = "JWT_AUDIENCE"
+	jwtClockSkew        = 30 * time.Second
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefresh limits refetches triggered by tokens with unknown key
+	// IDs, so garbage tokens can't hammer the JWKS endpoint.
+	jwksMinRefresh = time.Minute
+	jwksTimeout    = 5 * time.Second
+)
+
+// audience is the aud claim, which may be a single string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+// Claims are the verified claims of a bearer token.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+	IssuedAt  *float64 `json:"iat"`
+}
+
+type claimsKey struct{}
+
+// claimsFromContext returns the claims of the token that authenticated the
+// request, if JWT authentication is enabled.
+func claimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// jwtVerifier checks HS256 tokens against a shared secret and RS256 tokens
+// against the keys published at a JWKS URL.
+type jwtVerifier struct {
+	secret   []byte
+	jwks     *jwksCache
+	issuer   string
+	audience string
+}
+
+// newJWTVerifier returns nil when neither a secret nor a JWKS URL is set.
+func newJWTVerifier(cfg *Config) *jwtVerifier {
+	if cfg.JWTSecret == "" && cfg.JWTJWKSURL == "" {
+		return nil
+	}
+	v := &jwtVerifier{issuer: cfg.JWTIssuer, audience: cfg.JWTAudience}
+	if cfg.JWTSecret != "" {
+		v.secret = []byte(cfg.JWTSecret)
+	}
+	if cfg.JWTJWKSURL != "" {
+		v.jwks = &jwksCache{url: cfg.JWTJWKSURL, client: &http.Client{Timeout: jwksTimeout}}
+	}
+	return v
+}
+
+func decodeSegment(seg string, dst any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dst)
+}
+
+func (v *jwtVerifier) verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token must have three segments")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	// The algorithm is only trusted once it matches a configured key type,
+	// which rules out "none" and HS256 tokens signed with a public key.
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("invalid signature")
+		}
+	case header.Alg == "RS256" && v.jwks != nil:
+		key, err := v.jwks.key(ctx, header.Kid)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("claims: %w", err)
+	}
+	if err := v.checkClaims(&claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func numericDate(v float64) time.Time {
+	return time.Unix(0, int64(v*float64(time.Second)))
+}
+
+func (v *jwtVerifier) checkClaims(c *Claims, now time.Time) error {
+	if c.ExpiresAt == nil {
+		return errors.New("missing exp")
+	}
+	if now.After(numericDate(*c.ExpiresAt).Add(jwtClockSkew)) {
+		return errors.New("token expired")
+	}
+	if c.NotBefore != nil && now.Add(jwtClockSkew).Before(numericDate(*c.NotBefore)) {
+		return errors.New("token not valid yet")
+	}
+	if v.issuer != "" && c.Issuer != v.issuer {
+		return fmt.Errorf("unexpected iss %q", c.Issuer)
+	}
+	if v.audience != "" && !slices.Contains(c.Audience, v.audience) {
+		return errors.New("token not issued for this audience")
+	}
+	return nil
+}
+
+// jwksCache holds the RSA keys published at url, refetching them
+// periodically and when a token names a key it hasn't seen.
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	// refreshing is closed when the fetch in flight, if any, finishes.
+	refreshing chan struct{}
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.fetched) > jwksRefreshInterval
+	if (!ok && time.Since(c.fetched) > jwksMinRefresh) || stale {
+		if done := c.refreshing; done == nil {
+			c.refreshLocked(ctx)
+		} else if !ok {
+			// Another request is already fetching; wait for it rather than
+			// reject a token whose key is likely on its way.
+			c.mu.Unlock()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			c.mu.Lock()
+		}
+		key, ok = c.keys[kid]
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// refreshLocked refetches the keys. It is called with c.mu held and
+// releases it during the fetch, so requests with known keys don't queue
+// behind a slow JWKS endpoint.
+func (c *jwksCache) refreshLocked(ctx context.Context) {
+	done := make(chan struct{})
+	c.refreshing = done
+	// Rate-limit attempts, including failed ones.
+	c.fetched = time.Now()
+	c.mu.Unlock()
+
+	// Other requests may be waiting on this fetch, so it must not fail
+	// because this one went away; the client timeout still bounds it.
+	keys, err := c.fetch(context.WithoutCancel(ctx))
+
+	c.mu.Lock()
+	if err != nil {
+		// Keep serving the keys we have when a refresh fails.
+		logger.WarnContext(ctx, "Failed to fetch JWKS", "url", c.url, "error", err)
+	} else {
+		c.keys = keys
+	}
+	c.refreshing = nil
+	close(done)
+}
+
+// fetch downloads and parses the key set without touching the cache.
+func (c *jwksCache) fetch(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
+
+// requireJWT rejects requests without a valid bearer token and stores the
+// token's claims in the request context. It is a no-op when v is nil.
+func requireJWT(v *jwtVerifier, exempt ...string) middleware {
+	return func(next http.Handler) http.Handler {
+		if v == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasAnyPrefix(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, "Missing bearer token")
+				return
+			}
+			claims, err := v.verify(r.Context(), strings.TrimSpace(token))
+			if err != nil {
+				logger.InfoContext(r.Context(), "Rejected bearer token", "error", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeError(w, http.StatusUnauthorized, "Invalid bearer token")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func signHS256(t *testing.T, secret string, header, claims map[string]any) string {
+	t.Helper()
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	const secret = "test-secret"
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "kid": "key-1", "use": "sig",
+			"n": base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+
+	v := newJWTVerifier(&Config{
+		JWTSecret: secret, JWTJWKSURL: jwks.URL, JWTIssuer: "https://issuer.example", JWTAudience: "users-api",
+	})
+	now := time.Now().Unix()
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{"sub": "42", "iss": "https://issuer.example", "aud": "users-api", "exp": now + 600}
+		for k, val := range overrides {
+			c[k] = val
+		}
+		return c
+	}
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{name: "valid HS256", token: signHS256(t, secret, hs256, claims(nil))},
+		{
+			name:  "valid RS256",
+			token: signRS256(t, rsaKey, map[string]any{"alg": "RS256", "kid": "key-1"}, claims(nil)),
+		},
+		{
+			name:    "alg none",
+			token:   encodeSegment(t, map[string]any{"alg": "none"}) + "." + encodeSegment(t, claims(nil)) + ".",
+			wantErr: `unsupported alg "none"`,
+		},
+		{name: "wrong secret", token: signHS256(t, "other-secret", hs256, claims(nil)), wantErr: "invalid signature"},
+		{
+			name:    "expired",
+			token:   signHS256(t, secret, hs256, claims(map[string]any{"exp": now - 600})),
+			wantErr: "token expired",
+		},
+		{
+			name:    "not valid yet",
+			token:   signHS256(t, secret, hs256, claims(map[string]any{"nbf": now + 600})),
+			wantErr: "token not valid yet",
+		},
+		{
+			name:    "wrong issuer",
+			token:   signHS256(t, secret, hs256, claims(map[string]any{"iss": "https://evil.example"})),
+			wantErr: "unexpected iss",
+		},
+		{
+			name:    "wrong audience",
+			token:   signHS256(t, secret, hs256, claims(map[string]any{"aud": []string{"other-api"}})),
+			wantErr: "token not issued for this audience",
+		},
+		{
+			name:    "unknown kid",
+			token:   signRS256(t, rsaKey, map[string]any{"alg": "RS256", "kid": "key-2"}, claims(nil)),
+			wantErr: `unknown key id "key-2"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.verify(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify: %v", err)
+				}
+				if got.Subject != "42" {
+					t.Errorf("sub = %q, want 42", got.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	BindAddrEnvKey   = "BIND_ADDR"
+	unixSocketPrefix = "unix:"
+	loopbackHost     = "127.0.0.1"
+)
+
+// listen opens the server listener. bindAddr is either a host to combine
+// with port, where an empty host means all interfaces, or unix:<path> for a
+// Unix domain socket.
+func listen(bindAddr, port string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(bindAddr, unixSocketPrefix); ok {
+		// A socket file left behind by a previous run would make bind fail.
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", net.JoinHostPort(bindAddr, port))
+}
+
+// internalBindHost is the host the internal server listens on. It shares
+// BIND_ADDR, except that a Unix socket path can't be shared; the internal
+// server then stays on loopback, since it exposes pprof and metrics.
+func internalBindHost(bindAddr string) string {
+	if strings.HasPrefix(bindAddr, unixSocketPrefix) {
+		return loopbackHost
+	}
+	return bindAddr
+}
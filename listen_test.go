@@ -0,0 +1,16 @@
+package main
+
+import "testing"
+
+func TestInternalBindHost(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"10.0.0.5":               "10.0.0.5",
+		"unix:/run/app/api.sock": loopbackHost,
+	}
+	for bindAddr, want := range tests {
+		if got := internalBindHost(bindAddr); got != want {
+			t.Errorf("internalBindHost(%q) = %q, want %q", bindAddr, got, want)
+		}
+	}
+}
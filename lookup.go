@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+type LookupUsersRequest struct {
+	IDs []int `json:"ids"`
+}
+
+type LookupUsersResponse struct {
+	Users []UserResponse `json:"users"`
+}
+
+// handleLookupUsers resolves a list of IDs in one query, for clients that
+// would otherwise GET each user in turn.
+func (app *App) handleLookupUsers(w http.ResponseWriter, r *http.Request) {
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(r.Body)
+
+	var req LookupUsersRequest
+	if err := decodeJSON(r, &req, app.jsonLimits); err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if len(req.IDs) == 0 {
+		writeError(w, http.StatusBadRequest, "At least one id is required")
+		return
+	}
+	if len(req.IDs) > app.maxLookupIDs {
+		writeError(
+			w, http.StatusBadRequest,
+			fmt.Sprintf("%d ids exceed the maximum of %d", len(req.IDs), app.maxLookupIDs),
+		)
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	users, err := app.store.GetMany(ctx, req.IDs)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to get users from database", "Error looking up users")
+		return
+	}
+
+	response := LookupUsersResponse{Users: make([]UserResponse, len(users))}
+	for i, user := range users {
+		response.Users[i] = UserResponse(user)
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests handled.",
+		},
+		[]string{"route", "method", "status", "class"},
+	)
+	httpRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "method"},
+	)
+)
+
+func registerPoolMetrics(pool *pgxpool.Pool) {
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "db_pool_acquired_conns",
+			Help: "Number of currently acquired connections in the pool.",
+		},
+		func() float64 { return float64(pool.Stat().AcquiredConns()) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "db_pool_idle_conns",
+			Help: "Number of currently idle connections in the pool.",
+		},
+		func() float64 { return float64(pool.Stat().IdleConns()) },
+	)
+	promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "db_pool_total_conns",
+			Help: "Total number of connections currently in the pool.",
+		},
+		func() float64 { return float64(pool.Stat().TotalConns()) },
+	)
+}
+
+type PoolStatsResponse struct {
+	TotalConns              int32   `json:"total_conns"`
+	IdleConns               int32   `json:"idle_conns"`
+	AcquiredConns           int32   `json:"acquired_conns"`
+	ConstructingConns       int32   `json:"constructing_conns"`
+	MaxConns                int32   `json:"max_conns"`
+	AcquireCount            int64   `json:"acquire_count"`
+	AcquireDurationSeconds  float64 `json:"acquire_duration_seconds"`
+	EmptyAcquireCount       int64   `json:"empty_acquire_count"`
+	CanceledAcquireCount    int64   `json:"canceled_acquire_count"`
+	NewConnsCount           int64   `json:"new_conns_count"`
+	MaxLifetimeDestroyCount int64   `json:"max_lifetime_destroy_count"`
+	MaxIdleDestroyCount     int64   `json:"max_idle_destroy_count"`
+}
+
+// handlePoolStats reports pool.Stat() as JSON. EmptyAcquireCount counts
+// acquires that had to wait for a connection, the first sign of starvation.
+func (app *App) handlePoolStats(w http.ResponseWriter, r *http.Request) {
+	stat := app.db.Stat()
+	response := PoolStatsResponse{
+		TotalConns:              stat.TotalConns(),
+		IdleConns:               stat.IdleConns(),
+		AcquiredConns:           stat.AcquiredConns(),
+		ConstructingConns:       stat.ConstructingConns(),
+		MaxConns:                stat.MaxConns(),
+		AcquireCount:            stat.AcquireCount(),
+		AcquireDurationSeconds:  stat.AcquireDuration().Seconds(),
+		EmptyAcquireCount:       stat.EmptyAcquireCount(),
+		CanceledAcquireCount:    stat.CanceledAcquireCount(),
+		NewConnsCount:           stat.NewConnsCount(),
+		MaxLifetimeDestroyCount: stat.MaxLifetimeDestroyCount(),
+		MaxIdleDestroyCount:     stat.MaxIdleDestroyCount(),
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// routeLabel returns the path of the mux pattern r matches, such as
+// /api/users/{id}, so label cardinality is bounded by the number of routes
+// rather than by the IDs clients send.
+func routeLabel(mux *http.ServeMux, r *http.Request) string {
+	_, pattern := mux.Handler(r)
+	if pattern == "" {
+		return "unmatched"
+	}
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		return path
+	}
+	return pattern
+}
+
+// statusClass separates failures caused by the client from ours, so client
+// mistakes don't burn the error budget.
+func statusClass(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return "server_error"
+	case status >= http.StatusBadRequest:
+		return "client_error"
+	default:
+		return "success"
+	}
+}
+
+func instrumentRequests(mux *http.ServeMux) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			route := routeLabel(mux, r)
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			httpRequestsTotal.WithLabelValues(route, r.Method, strconv.Itoa(rec.status), statusClass(rec.status)).Inc()
+			httpRequestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AllowedOriginsEnvKey      = "ALLOWED_ORIGINS"
+	APIKeyEnvKey              = "API_KEY"
+	SecurityHeadersEnvKey     = "SECURITY_HEADERS"
+	HSTSMaxAgeEnvKey          = "HSTS_MAX_AGE"
+	defaultHSTSMaxAge         = 365 * 24 * time.Hour
+	apiKeyHeader              = "X-API-Key"
+	corsAllowedMethods        = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	CORSAllowedHeadersEnvKey  = "CORS_ALLOWED_HEADERS"
+	CORSMaxAgeEnvKey          = "CORS_MAX_AGE"
+	defaultCORSAllowedHeaders = "Content-Type, Authorization, X-API-Key, X-Request-ID, Idempotency-Key"
+	defaultCORSMaxAge         = 10 * time.Minute
+)
+
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h with mws so that the first middleware is the outermost one.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// jsonMuxErrors serves requests with mux, answering the 404 and 405 that
+// mux generates itself when no pattern matches with the JSON error
+// envelope instead of plain text. The Allow header mux sets on a 405 is
+// kept. Handlers that return 404 themselves are left alone.
+func jsonMuxErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(&muxErrorWriter{ResponseWriter: w}, r)
+	})
+}
+
+// muxErrorWriter replaces a plain-text 404 or 405 with writeError and drops
+// the body that follows it.
+type muxErrorWriter struct {
+	http.ResponseWriter
+	replaced bool
+}
+
+func (w *muxErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		w.replaced = true
+		writeError(w.ResponseWriter, status, "Not found")
+	case http.StatusMethodNotAllowed:
+		w.replaced = true
+		writeError(w.ResponseWriter, status, "Method not allowed")
+	default:
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *muxErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if err, ok := rec.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(rec)
+			}
+			logger.ErrorContext(
+				r.Context(), "Recovered from panic",
+				"panic", rec,
+				"stack", string(debug.Stack()),
+			)
+			writeError(w, http.StatusInternalServerError, "Internal server error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// prettyWriter marks a response whose JSON writeJSON should indent.
+type prettyWriter struct {
+	http.ResponseWriter
+}
+
+func (pw *prettyWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
+
+// prettyJSON indents JSON responses of requests with ?pretty=true, for
+// reading them in a terminal. It must be the innermost middleware so
+// handlers receive the prettyWriter itself.
+func prettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("pretty") == "true" {
+			w = &prettyWriter{w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// securityHeaders sets hardening headers on every response, adding
+// Strict-Transport-Security when the request came in over TLS. Setting
+// SECURITY_HEADERS=false turns it off, and HSTS_MAX_AGE tunes the HSTS
+// max-age (default one year).
+func securityHeaders(enabled bool, hstsMaxAge time.Duration) middleware {
+	hsts := "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		if !enabled {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+			if r.TLS != nil {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitBody caps request bodies at maxBytes; reading past the limit fails
+// with an *http.MaxBytesError.
+func limitBody(maxBytes int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// cors allows cross-origin requests from the origins listed in
+// ALLOWED_ORIGINS; "*" allows any origin. It is a no-op when unset.
+// Browsers may cache preflight results for maxAge (CORS_MAX_AGE), and
+// allowedHeaders (CORS_ALLOWED_HEADERS) lists the request headers allowed.
+func cors(origins, allowedHeaders []string, maxAge time.Duration) middleware {
+	allowAny := slices.Contains(origins, "*")
+	headers := strings.Join(allowedHeaders, ", ")
+	maxAgeSeconds := strconv.Itoa(int(maxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		if len(origins) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			if !allowAny && !slices.Contains(origins, origin) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if allowAny {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Max-Age", maxAgeSeconds)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func validAPIKey(key string, keys []string) bool {
+	valid := 0
+	for _, k := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return valid == 1
+}
+
+// requireAPIKey rejects requests without a valid X-API-Key header. API_KEY
+// holds a comma-separated list of accepted keys so they can be rotated, and
+// auth is disabled when it is unset. Paths starting with one of the exempt
+// prefixes are always allowed through.
+func requireAPIKey(keys []string, exempt ...string) middleware {
+	if len(keys) == 0 {
+		logger.Warn("API key authentication is disabled", "key", APIKeyEnvKey)
+	}
+
+	return func(next http.Handler) http.Handler {
+		if len(keys) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasAnyPrefix(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := r.Header.Get(apiKeyHeader)
+			if key == "" {
+				writeError(w, http.StatusUnauthorized, "Missing API key")
+				return
+			}
+			if !validAPIKey(key, keys) {
+				writeError(w, http.StatusUnauthorized, "Invalid API key")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
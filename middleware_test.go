@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONMuxErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+usersPath+"/{id}", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "user not found")
+	})
+	mux.HandleFunc("PUT "+usersPath+"/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := jsonMuxErrors(mux)
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		want      ErrorResponse
+		wantAllow string
+	}{
+		{
+			name: "unknown path", method: http.MethodGet, path: "/nope",
+			want: ErrorResponse{Error: "Not found", Status: http.StatusNotFound},
+		},
+		{
+			name: "unsupported method", method: http.MethodPost, path: usersPath + "/1",
+			want:      ErrorResponse{Error: "Method not allowed", Status: http.StatusMethodNotAllowed},
+			wantAllow: "GET, HEAD, PUT",
+		},
+		{
+			name: "handler 404 untouched", method: http.MethodGet, path: usersPath + "/1",
+			want: ErrorResponse{Error: "user not found", Status: http.StatusNotFound},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if w.Code != tt.want.Status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want.Status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			if allow := w.Header().Get("Allow"); allow != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", allow, tt.wantAllow)
+			}
+			var got ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body %q is not JSON: %v", w.Body.String(), err)
+			}
+			if got != tt.want {
+				t.Errorf("body = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+-- Names were not unique before this migration, and adding the constraint
+-- to a table that holds duplicates fails with a bare unique violation.
+-- Check first and stop with the names to fix instead. To upgrade such a
+-- database, rename or delete all but one user of each listed name, for
+-- example keeping the oldest:
+--
+--   UPDATE users SET name = name || ' (' || id || ')'
+--   WHERE id NOT IN (SELECT min(id) FROM users GROUP BY name);
+--
+-- then restart the app; this migration has not been recorded as applied,
+-- so it runs again.
+DO $$
+DECLARE
+	duplicates text;
+BEGIN
+	SELECT string_agg(format('%L (%s users)', name, n), ', ' ORDER BY name)
+	INTO duplicates
+	FROM (SELECT name, count(*) AS n FROM users GROUP BY name HAVING count(*) > 1) AS d;
+
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION 'cannot make users.name unique: duplicate names %', duplicates
+			USING HINT = 'Rename or delete the duplicate users, then restart; see migrations/0002_users_name_unique.sql.';
+	END IF;
+END;
+$$;
+
+ALTER TABLE users ADD CONSTRAINT users_name_key UNIQUE (name);
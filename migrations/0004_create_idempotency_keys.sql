@@ -0,0 +1,7 @@
+CREATE TABLE idempotency_keys (
+    key TEXT PRIMARY KEY,
+    response JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX idempotency_keys_created_at_idx ON idempotency_keys (created_at);
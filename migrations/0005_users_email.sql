@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN email TEXT CONSTRAINT users_email_key UNIQUE;
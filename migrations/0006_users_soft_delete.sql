@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- Only live users need unique names and emails, so both can be reused once
+-- a user is soft-deleted.
+ALTER TABLE users DROP CONSTRAINT users_name_key;
+CREATE UNIQUE INDEX users_name_key ON users (name) WHERE deleted_at IS NULL;
+
+ALTER TABLE users DROP CONSTRAINT users_email_key;
+CREATE UNIQUE INDEX users_email_key ON users (email) WHERE deleted_at IS NULL;
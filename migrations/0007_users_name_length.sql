@@ -0,0 +1,6 @@
+-- Backstop for MAX_NAME_LENGTH, so oversized names can't be stored by
+-- anything that bypasses the API. NOT VALID skips checking existing rows,
+-- which would otherwise block the migration on a table that already holds
+-- longer names; new and updated rows are still checked.
+ALTER TABLE users
+    ADD CONSTRAINT users_name_length CHECK (char_length(name) <= 255) NOT VALID;
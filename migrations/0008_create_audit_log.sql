@@ -0,0 +1,12 @@
+CREATE TABLE audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    action TEXT NOT NULL,
+    -- Not a foreign key: entries must outlive the users they describe.
+    user_id INTEGER,
+    actor TEXT NOT NULL,
+    before JSONB,
+    after JSONB,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX audit_log_user_id_idx ON audit_log (user_id);
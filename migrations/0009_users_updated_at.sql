@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- Existing rows have not changed since they were created.
+UPDATE users SET updated_at = created_at;
@@ -0,0 +1,12 @@
+-- Maintain updated_at in the database, so it is right for every UPDATE
+-- whether or not it comes from the app.
+CREATE FUNCTION set_updated_at() RETURNS trigger AS $$
+BEGIN
+	NEW.updated_at = now();
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_set_updated_at
+	BEFORE UPDATE ON users
+	FOR EACH ROW EXECUTE FUNCTION set_updated_at();
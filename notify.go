@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	userCreatedChannel   = "user_created"
+	listenInitialBackoff = 500 * time.Millisecond
+	listenMaxBackoff     = 30 * time.Second
+)
+
+// notifyUserCreated queues a user_created notification carrying the user as
+// JSON. Postgres only delivers it once tx commits, so listeners never hear
+// about an insert that was rolled back.
+func notifyUserCreated(ctx context.Context, tx pgx.Tx, user User) error {
+	payload, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "SELECT pg_notify($1, $2)", userCreatedChannel, string(payload))
+	return err
+}
+
+// Listen subscribes to channel on a dedicated connection, outside of the
+// pool, and calls handler for every notification until ctx is cancelled.
+// When the connection is lost, for example during a failover, it logs the
+// error and reconnects with backoff. connected reports whether the
+// subscription is currently live; notifications sent while it is down are
+// lost.
+func Listen(ctx context.Context, pool *pgxpool.Pool, channel string, handler func(*pgconn.Notification), connected *atomic.Bool) {
+	backoff := listenInitialBackoff
+	for {
+		err := listenOnce(ctx, pool, channel, handler, func() {
+			connected.Store(true)
+			backoff = listenInitialBackoff
+			logger.Info("Listening for notifications", "channel", channel)
+		})
+		connected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Error("Lost notification listener, reconnecting", "channel", channel, "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, listenMaxBackoff)
+	}
+}
+
+// listenOnce runs a single LISTEN session, calling subscribed once the
+// channel is subscribed. It only returns on error or when ctx is done.
+func listenOnce(ctx context.Context, pool *pgxpool.Pool, channel string, handler func(*pgconn.Notification), subscribed func()) error {
+	conn, err := pgx.ConnectConfig(ctx, pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close(context.Background())
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return err
+	}
+	subscribed()
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handler(notification)
+	}
+}
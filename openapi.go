@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const openAPIPath = "/openapi.json"
+
+// openAPIValuer is implemented by wrapper types such as Optional that
+// appear in JSON as the type they wrap.
+type openAPIValuer interface {
+	openAPIValueType() reflect.Type
+}
+
+func (Optional[T]) openAPIValueType() reflect.Type {
+	return reflect.TypeFor[T]()
+}
+
+// schemaGenerator derives OpenAPI schemas from Go types using their json
+// tags, collecting every named struct it meets as a component.
+type schemaGenerator struct {
+	components map[string]any
+}
+
+func (g *schemaGenerator) ref(v any) map[string]any {
+	return g.schema(reflect.TypeOf(v))
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	if v, ok := reflect.Zero(t).Interface().(openAPIValuer); ok {
+		return g.schema(v.openAPIValueType())
+	}
+	if t == reflect.TypeFor[time.Time]() {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	// Raw messages hold encoded JSON, such as an audit snapshot, rather
+	// than the bytes their slice type suggests.
+	if t == reflect.TypeFor[json.RawMessage]() {
+		return map[string]any{"type": "object", "nullable": true}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := g.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return map[string]any{"allOf": []any{s}, "nullable": true}
+		}
+		s["nullable"] = true
+		return s
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.components[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate.
+			g.components[t.Name()] = nil
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+
+		_, optional := reflect.Zero(field.Type).Interface().(openAPIValuer)
+		omitted := strings.Contains(opts, "omitempty") || strings.Contains(opts, "omitzero")
+		if !optional && field.Type.Kind() != reflect.Pointer && !omitted {
+			required = append(required, name)
+		}
+	}
+
+	s := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func jsonContent(schema map[string]any) map[string]any {
+	return map[string]any{"application/json": map[string]any{"schema": schema}}
+}
+
+func queryParam(name, typ, description string) map[string]any {
+	return map[string]any{
+		"name": name, "in": "query", "description": description,
+		"schema": map[string]any{"type": typ},
+	}
+}
+
+var userIDParam = map[string]any{
+	"name": "id", "in": "path", "required": true,
+	"schema": map[string]any{"type": "integer"},
+}
+
+var includeDeletedParam = queryParam("include_deleted", "boolean", "Also return soft-deleted users.")
+
+// buildOpenAPISpec describes the API. Operations are listed by hand while
+// every schema comes from the Go types the handlers encode and decode.
+func buildOpenAPISpec(basePath string) map[string]any {
+	g := &schemaGenerator{components: map[string]any{}}
+	errorSchema := g.ref(ErrorResponse{})
+
+	responses := func(status int, description string, schema map[string]any, errors ...int) map[string]any {
+		rs := map[string]any{}
+		ok := map[string]any{"description": description}
+		if schema != nil {
+			ok["content"] = jsonContent(schema)
+		}
+		rs[strconv.Itoa(status)] = ok
+		for _, code := range errors {
+			rs[strconv.Itoa(code)] = map[string]any{
+				"description": http.StatusText(code),
+				"content":     jsonContent(errorSchema),
+			}
+		}
+		return rs
+	}
+	validationResponse := map[string]any{
+		"description": "The request has invalid fields",
+		"content":     jsonContent(g.ref(ValidationError{})),
+	}
+	withValidation := func(rs map[string]any) map[string]any {
+		rs["422"] = validationResponse
+		return rs
+	}
+	body := func(v any) map[string]any {
+		return map[string]any{"required": true, "content": jsonContent(g.ref(v))}
+	}
+
+	getUserResponses := responses(http.StatusOK, "The user", g.ref(UserResponse{}), 400, 404)
+	getUserResponses["200"].(map[string]any)["headers"] = map[string]any{
+		"ETag": map[string]any{"schema": map[string]any{"type": "string"}},
+	}
+	getUserResponses["304"] = map[string]any{"description": "The user has not changed since the given ETag"}
+	listParams := []any{
+		queryParam("limit", "integer", "Page size, at most "+strconv.Itoa(maxUsersLimit)+"."),
+		queryParam("offset", "integer", "Rows to skip."),
+		queryParam("after", "integer", "Return users with a larger ID; enables next_cursor."),
+		queryParam("q", "string", "Case-insensitive name search."),
+		queryParam("sort", "string", "Comma-separated sort keys among id, name and created_at; prefix - for descending."),
+		includeDeletedParam,
+	}
+	listResponses := responses(http.StatusOK, "A page of users", g.ref(GetUsersResponse{}), 400, 504)
+	listResponses["200"].(map[string]any)["content"].(map[string]any)[ndjsonContentType] = map[string]any{
+		"schema": g.ref(User{}),
+	}
+	listResponses["200"].(map[string]any)["content"].(map[string]any)[csvContentType] = map[string]any{
+		"schema": map[string]any{"type": "string"},
+	}
+
+	addResponses := withValidation(
+		responses(http.StatusCreated, "The created user", g.ref(UserResponse{}), 400, 409, 413, 415),
+	)
+	addResponses["204"] = map[string]any{"description": "With validate=true, the payload is valid"}
+
+	paths := map[string]any{
+		usersPath: map[string]any{
+			"get": map[string]any{
+				"summary":    "List users",
+				"parameters": listParams,
+				"responses":  listResponses,
+			},
+			"post": map[string]any{
+				"summary": "Create a user",
+				"parameters": []any{
+					queryParam("validate", "boolean", "Only validate the payload."),
+					map[string]any{
+						"name": idempotencyKeyHeader, "in": "header",
+						"schema": map[string]any{"type": "string", "maxLength": maxIdempotencyKeyLength},
+					},
+				},
+				"requestBody": body(AddUserRequest{}),
+				"responses":   addResponses,
+			},
+			"delete": map[string]any{
+				"summary":   "Remove every user; only enabled with ALLOW_RESET=true",
+				"responses": responses(http.StatusOK, "The number of removed users", g.ref(ResetUsersResponse{}), 403),
+			},
+		},
+		usersPath + "/count": map[string]any{
+			"get": map[string]any{
+				"summary": "Count users",
+				"parameters": []any{
+					queryParam("q", "string", "Case-insensitive name search."),
+					includeDeletedParam,
+				},
+				"responses": responses(http.StatusOK, "The number of users", g.ref(CountUsersResponse{}), 504),
+			},
+		},
+		usersPath + "/stats": map[string]any{
+			"get": map[string]any{
+				"summary":   "Count live users, in total and created today and this week",
+				"responses": responses(http.StatusOK, "User stats", g.ref(UserStatsResponse{}), 504),
+			},
+		},
+		usersPath + "/lookup": map[string]any{
+			"post": map[string]any{
+				"summary":     "Get several live users by ID, skipping unknown IDs",
+				"requestBody": body(LookupUsersRequest{}),
+				"responses": responses(
+					http.StatusOK, "The users that were found", g.ref(LookupUsersResponse{}), 400, 413, 415, 504,
+				),
+			},
+		},
+		usersPath + "/bulk-delete": map[string]any{
+			"post": map[string]any{
+				"summary":     "Soft-delete several users in one transaction",
+				"requestBody": body(BulkDeleteUsersRequest{}),
+				"responses": responses(
+					http.StatusOK, "How many of the users were deleted", g.ref(BulkDeleteUsersResponse{}), 400, 413, 415,
+				),
+			},
+		},
+		usersPath + "/recent": map[string]any{
+			"get": map[string]any{
+				"summary": "List the newest live users, newest first",
+				"parameters": []any{
+					queryParam("n", "integer", "How many users, at most "+strconv.Itoa(maxRecentUsers)+"."),
+				},
+				"responses": responses(http.StatusOK, "The newest users", g.ref(RecentUsersResponse{}), 400, 504),
+			},
+		},
+		usersPath + "/batch": map[string]any{
+			"post": map[string]any{
+				"summary": "Create several users in one transaction",
+				"requestBody": map[string]any{"required": true, "content": jsonContent(map[string]any{
+					"oneOf": []any{g.ref(BatchAddUsersRequest{}), g.ref([]AddUserRequest{})},
+				})},
+				"responses": withValidation(responses(
+					http.StatusCreated, "The created users", g.ref(BatchAddUsersResponse{}), 400, 409, 413, 415,
+				)),
+			},
+		},
+		usersPath + "/import": map[string]any{
+			"post": map[string]any{
+				"summary": "Import users from a CSV file with a name column",
+				"requestBody": map[string]any{
+					"required": true,
+					"content":  map[string]any{csvContentType: map[string]any{"schema": map[string]any{"type": "string"}}},
+				},
+				"responses": responses(
+					http.StatusCreated, "The number of imported users", g.ref(ImportUsersResponse{}), 400, 409, 413,
+				),
+			},
+		},
+		usersPath + "/stream": map[string]any{
+			"get": map[string]any{
+				"summary": "Stream newly created users as server-sent events",
+				"responses": map[string]any{"200": map[string]any{
+					"description": "user_created events carrying a User",
+					"content":     map[string]any{sseContentType: map[string]any{"schema": g.ref(User{})}},
+				}},
+			},
+		},
+		usersPath + "/{id}": map[string]any{
+			"parameters": []any{userIDParam},
+			"get": map[string]any{
+				"summary": "Get a user",
+				"parameters": []any{
+					includeDeletedParam,
+					map[string]any{
+						"name": "If-None-Match", "in": "header", "schema": map[string]any{"type": "string"},
+						"description": "ETag from an earlier response; 304 when the user has not changed.",
+					},
+				},
+				"responses": getUserResponses,
+			},
+			"head": map[string]any{
+				"summary":    "Get the headers of a user without the body",
+				"parameters": []any{includeDeletedParam},
+				"responses": map[string]any{
+					"200": map[string]any{
+						"description": "The user exists",
+						"headers": map[string]any{
+							"ETag":           map[string]any{"schema": map[string]any{"type": "string"}},
+							"Content-Length": map[string]any{"schema": map[string]any{"type": "integer"}},
+						},
+					},
+					"304": map[string]any{"description": "The user has not changed since the given ETag"},
+					"400": map[string]any{"description": "The user ID is invalid"},
+					"404": map[string]any{"description": "The user does not exist"},
+				},
+			},
+			"put": map[string]any{
+				"summary":     "Replace a user",
+				"requestBody": body(UpdateUserRequest{}),
+				"responses": withValidation(
+					responses(http.StatusOK, "The updated user", g.ref(UserResponse{}), 400, 404, 409, 415),
+				),
+			},
+			"patch": map[string]any{
+				"summary":     "Update some fields of a user",
+				"requestBody": body(PatchUserRequest{}),
+				"responses": withValidation(
+					responses(http.StatusOK, "The updated user", g.ref(UserResponse{}), 400, 404, 409, 415),
+				),
+			},
+			"delete": map[string]any{
+				"summary":   "Soft-delete a user",
+				"responses": responses(http.StatusNoContent, "The user was deleted", nil, 400, 404),
+			},
+		},
+		usersPath + "/{id}/restore": map[string]any{
+			"parameters": []any{userIDParam},
+			"post": map[string]any{
+				"summary":   "Restore a soft-deleted user",
+				"responses": responses(http.StatusOK, "The restored user", g.ref(UserResponse{}), 400, 404, 409),
+			},
+		},
+		usersV2Path: map[string]any{
+			"get": map[string]any{
+				"summary":    "List users, in the v2 envelope",
+				"parameters": listParams,
+				"responses":  responses(http.StatusOK, "A page of users", g.ref(GetUsersV2Response{}), 400, 504),
+			},
+		},
+		usersV2Path + "/{id}": map[string]any{
+			"parameters": []any{userIDParam},
+			"get": map[string]any{
+				"summary":    "Get a user, in the v2 envelope",
+				"parameters": []any{includeDeletedParam},
+				"responses":  responses(http.StatusOK, "The user", g.ref(GetUserV2Response{}), 400, 404),
+			},
+		},
+		auditPath: map[string]any{
+			"get": map[string]any{
+				"summary": "List audit entries for user mutations, newest first",
+				"parameters": []any{
+					queryParam("limit", "integer", "Page size, at most "+strconv.Itoa(maxUsersLimit)+"."),
+					queryParam("offset", "integer", "Rows to skip."),
+					queryParam("user_id", "integer", "Only entries about this user."),
+				},
+				"responses": responses(http.StatusOK, "A page of audit entries", g.ref(GetAuditResponse{}), 400, 504),
+			},
+		},
+		"/_internal/health": map[string]any{
+			"get": map[string]any{
+				"summary":   "Health check",
+				"security":  []any{},
+				"responses": responses(http.StatusOK, "The service and its database are up", g.ref(HealthResponse{})),
+			},
+		},
+		"/_internal/healthz/detailed": map[string]any{
+			"get": map[string]any{
+				"summary":  "Database health with ping latency",
+				"security": []any{},
+				"responses": responses(
+					http.StatusOK, "The databases are up, possibly degraded", g.ref(DetailedHealthResponse{}),
+				),
+			},
+		},
+		"/_internal/readyz": map[string]any{
+			"get": map[string]any{
+				"summary":   "Readiness check",
+				"security":  []any{},
+				"responses": responses(http.StatusOK, "The service is ready", g.ref(ReadinessResponse{})),
+			},
+		},
+		"/_internal/version": map[string]any{
+			"get": map[string]any{
+				"summary":   "Build information",
+				"security":  []any{},
+				"responses": responses(http.StatusOK, "The running build", g.ref(VersionResponse{})),
+			},
+		},
+	}
+
+	spec := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   serviceName,
+			"version": buildVersion().Version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.components,
+			"securitySchemes": map[string]any{
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []any{map[string]any{"apiKey": []any{}}, map[string]any{"bearer": []any{}}},
+	}
+	if basePath != "" {
+		spec["servers"] = []any{map[string]any{"url": basePath}}
+	}
+	return spec
+}
+
+// handleOpenAPI serves the spec, which is built once since it only depends
+// on types, constants and the base path.
+func handleOpenAPI(basePath string) http.HandlerFunc {
+	spec, err := json.Marshal(buildOpenAPISpec(basePath))
+	if err != nil {
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(spec)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOpenAPISpecSchemas(t *testing.T) {
+	spec := buildOpenAPISpec("")
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+	auditEntry, ok := schemas["AuditEntry"].(map[string]any)
+	if !ok {
+		t.Fatal("AuditEntry schema missing")
+	}
+	properties := auditEntry["properties"].(map[string]any)
+	want := map[string]any{"type": "object", "nullable": true}
+	for _, name := range []string{"before", "after"} {
+		if got := properties[name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("AuditEntry.%s schema = %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	RateLimitRPSEnvKey         = "RATE_LIMIT_RPS"
+	RateLimitBurstEnvKey       = "RATE_LIMIT_BURST"
+	TrustProxyEnvKey           = "TRUST_PROXY"
+	defaultRateLimitRPS        = 10
+	defaultRateLimitBurst      = 20
+	rateLimiterTTL             = 3 * time.Minute
+	rateLimiterCleanupInterval = time.Minute
+)
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	rps      rate.Limit
+	burst    int
+}
+
+func newIPRateLimiter(rps rate.Limit, burst int) *ipRateLimiter {
+	l := &ipRateLimiter{
+		limiters: make(map[string]*limiterEntry),
+		rps:      rps,
+		burst:    burst,
+	}
+	go l.cleanup()
+	return l
+}
+
+func (l *ipRateLimiter) get(ip string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+// cleanup drops limiters for clients that have not been seen for
+// rateLimiterTTL so the map does not grow without bound.
+func (l *ipRateLimiter) cleanup() {
+	ticker := time.NewTicker(rateLimiterCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.mu.Lock()
+		for ip, entry := range l.limiters {
+			if time.Since(entry.lastSeen) > rateLimiterTTL {
+				delete(l.limiters, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientIP returns the address of the client. When trustProxy is set the
+// last X-Forwarded-For entry, appended by our own proxy, is used instead of
+// the connection's remote address.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit limits each client IP to rps requests per second with bursts
+// of up to burst. It is a no-op when rps is 0.
+func rateLimit(rps, burst int, trustProxy bool, exempt ...string) middleware {
+	return func(next http.Handler) http.Handler {
+		if rps == 0 {
+			return next
+		}
+		limiter := newIPRateLimiter(rate.Limit(rps), burst)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasAnyPrefix(r.URL.Path, exempt) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reservation := limiter.get(clientIP(r, trustProxy)).Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
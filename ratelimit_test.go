@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		rps, burst int
+		wantOK     int
+	}{
+		{name: "disabled", rps: 0, burst: defaultRateLimitBurst, wantOK: 5},
+		{name: "burst", rps: 1, burst: 2, wantOK: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := rateLimit(tt.rps, tt.burst, false)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+			ok := 0
+			for range 5 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, usersPath, nil))
+				if w.Code == http.StatusOK {
+					ok++
+				} else if w.Code != http.StatusTooManyRequests {
+					t.Fatalf("status = %d, want 200 or 429", w.Code)
+				}
+			}
+			if ok != tt.wantOK {
+				t.Errorf("%d of 5 requests allowed, want %d", ok, tt.wantOK)
+			}
+		})
+	}
+}
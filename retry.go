@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	DbQueryRetriesEnvKey     = "DB_QUERY_RETRIES"
+	defaultDbQueryRetries    = 2
+	queryRetryInitialBackoff = 50 * time.Millisecond
+	queryRetryMaxBackoff     = time.Second
+)
+
+// retryPolicy re-runs queries that failed with a transient error, such as
+// a connection reset during a failover.
+type retryPolicy struct {
+	retries int
+}
+
+// do calls fn until it succeeds, fails with an error that is not
+// retryable, or has been retried p.retries times. Pass idempotent only when
+// fn is safe to repeat after it may already have taken effect; otherwise
+// fn is only retried when the server guarantees it had no effect.
+func (p retryPolicy) do(ctx context.Context, idempotent bool, fn func() error) error {
+	backoff := queryRetryInitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt > p.retries || !isRetryable(err, idempotent) {
+			return err
+		}
+		logger.WarnContext(
+			ctx, "Query failed, retrying",
+			"attempt", attempt, "retries", p.retries, "retry_in", backoff, "error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, queryRetryMaxBackoff)
+	}
+}
+
+// isRetryable reports whether err is worth retrying. Serialization
+// failures, deadlocks and errors raised before anything reached the server
+// always are; a dropped connection only is for idempotent work, since the
+// statement may or may not have run.
+func isRetryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == "40001", pgErr.Code == "40P01":
+			return true
+		case pgErr.Code == "57P01", pgErr.Code == "57P02", pgErr.Code == "57P03",
+			len(pgErr.Code) == 5 && pgErr.Code[:2] == "08":
+			// Server shutting down or connection exception.
+			return idempotent
+		default:
+			return false
+		}
+	}
+
+	var connectErr *pgconn.ConnectError
+	if pgconn.SafeToRetry(err) || errors.As(err, &connectErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return idempotent
+	}
+	return false
+}
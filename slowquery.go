@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	SlowQueryThresholdEnvKey  = "SLOW_QUERY_THRESHOLD"
+	defaultSlowQueryThreshold = 500 * time.Millisecond
+)
+
+type tracedQueryKey struct{}
+
+type tracedQuery struct {
+	sql   string
+	start time.Time
+}
+
+type tracedBatchKey struct{}
+
+// tracedBatch times the statements of a batch. pgx only reports each one
+// as its result is read, so a statement is timed from the end of the one
+// before it, or from the start of the batch for the first.
+type tracedBatch struct {
+	last time.Time
+}
+
+// slowQueryTracer logs every statement on a connection that takes longer
+// than threshold, including batched and prepared ones and the ones pgx and
+// the pool issue themselves. Arguments are left out since they may hold
+// user data.
+type slowQueryTracer struct {
+	threshold time.Duration
+	role      string
+}
+
+func (t *slowQueryTracer) start(ctx context.Context, sql string) context.Context {
+	return context.WithValue(ctx, tracedQueryKey{}, tracedQuery{sql: sql, start: time.Now()})
+}
+
+func (t *slowQueryTracer) end(ctx context.Context, err error) {
+	q, ok := ctx.Value(tracedQueryKey{}).(tracedQuery)
+	if !ok {
+		return
+	}
+	t.log(ctx, q.sql, time.Since(q.start), err)
+}
+
+func (t *slowQueryTracer) log(ctx context.Context, sql string, elapsed time.Duration, err error) {
+	if elapsed > t.threshold {
+		logger.WarnContext(
+			ctx, "Slow query",
+			"role", t.role, "sql", sql, "duration_ms", elapsed.Milliseconds(), "error", err,
+		)
+	}
+}
+
+func (t *slowQueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return t.start(ctx, data.SQL)
+}
+
+func (t *slowQueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *slowQueryTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	return t.start(ctx, "COPY "+data.TableName.Sanitize())
+}
+
+func (t *slowQueryTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.end(ctx, data.Err)
+}
+
+func (t *slowQueryTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceBatchStartData) context.Context {
+	return context.WithValue(ctx, tracedBatchKey{}, &tracedBatch{last: time.Now()})
+}
+
+func (t *slowQueryTracer) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	b, ok := ctx.Value(tracedBatchKey{}).(*tracedBatch)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	t.log(ctx, data.SQL, now.Sub(b.last), data.Err)
+	b.last = now
+}
+
+func (t *slowQueryTracer) TraceBatchEnd(context.Context, *pgx.Conn, pgx.TraceBatchEndData) {}
+
+func (t *slowQueryTracer) TracePrepareStart(ctx context.Context, _ *pgx.Conn, data pgx.TracePrepareStartData) context.Context {
+	return t.start(ctx, "PREPARE "+data.SQL)
+}
+
+func (t *slowQueryTracer) TracePrepareEnd(ctx context.Context, _ *pgx.Conn, data pgx.TracePrepareEndData) {
+	t.end(ctx, data.Err)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestSlowQueryTracerBatch(t *testing.T) {
+	var buf bytes.Buffer
+	saved := logger
+	logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	t.Cleanup(func() { logger = saved })
+
+	tracer := &slowQueryTracer{threshold: 20 * time.Millisecond, role: "primary"}
+	batch := &pgx.Batch{}
+	batch.Queue("INSERT INTO users (name) VALUES ($1)", "slow")
+	batch.Queue("SELECT 1")
+
+	ctx := tracer.TraceBatchStart(context.Background(), nil, pgx.TraceBatchStartData{Batch: batch})
+	time.Sleep(2 * tracer.threshold)
+	tracer.TraceBatchQuery(ctx, nil, pgx.TraceBatchQueryData{SQL: batch.QueuedQueries[0].SQL})
+	tracer.TraceBatchQuery(ctx, nil, pgx.TraceBatchQueryData{SQL: batch.QueuedQueries[1].SQL})
+	tracer.TraceBatchEnd(ctx, nil, pgx.TraceBatchEndData{})
+
+	out := buf.String()
+	if !strings.Contains(out, `"sql":"INSERT INTO users (name) VALUES ($1)"`) {
+		t.Errorf("slow batch statement not logged: %s", out)
+	}
+	if strings.Contains(out, `"sql":"SELECT 1"`) {
+		t.Errorf("fast batch statement logged: %s", out)
+	}
+}
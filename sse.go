@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	sseContentType    = "text/event-stream"
+	sseHeartbeatEvery = 15 * time.Second
+	// sseSubscriberBuffer is how many events a slow client may fall behind
+	// before further events are dropped for it.
+	sseSubscriberBuffer = 16
+)
+
+// broadcaster fans notification payloads out to every subscriber, so all
+// SSE clients share a single LISTEN connection.
+type broadcaster struct {
+	mu     sync.Mutex
+	subs   map[chan string]struct{}
+	closed bool
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{subs: make(map[chan string]struct{})}
+}
+
+func (b *broadcaster) subscribe() (<-chan string, func()) {
+	ch := make(chan string, sseSubscriberBuffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close ends every subscription, which lets open event streams return so
+// they do not hold up a graceful shutdown.
+func (b *broadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+func (b *broadcaster) publish(payload string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- payload:
+		default:
+		}
+	}
+}
+
+func (b *broadcaster) handleNotification(n *pgconn.Notification) {
+	b.publish(n.Payload)
+}
+
+// handleUserStream sends every newly created user to the client as a
+// user_created server-sent event until the client disconnects.
+func (app *App) handleUserStream(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream is meant to stay open well past the server write timeout.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.WarnContext(r.Context(), "Could not clear write deadline for event stream", "error", err)
+	}
+
+	events, unsubscribe := app.userEvents.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", sseContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.ErrorContext(r.Context(), "Streaming not supported", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatEvery)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case payload, ok := <-events:
+			if !ok {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", userCreatedChannel, payload)
+		case <-heartbeat.C:
+			// Comment lines keep proxies from closing an idle connection.
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			logger.WarnContext(r.Context(), "Event stream closed", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,782 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sony/gobreaker"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrNameExists   = errors.New("name already exists")
+	ErrEmailExists  = errors.New("email already exists")
+	ErrNameTooLong  = errors.New("name is too long")
+)
+
+// userColumns lists the columns scanUser expects, in order.
+const userColumns = "id, name, email, created_at, updated_at, deleted_at"
+
+// usersEmailConstraint is the unique index on live users' emails.
+const usersEmailConstraint = "users_email_key"
+
+// usersNameLengthConstraint caps name length in the database.
+const usersNameLengthConstraint = "users_name_length"
+
+// noLimit can be used as ListUsersParams.Limit to return every matching row.
+const noLimit = -1
+
+// UserFilter selects which users List, Stream and Count see.
+type UserFilter struct {
+	// Query filters users whose name contains it, case-insensitively.
+	Query string
+	// IncludeDeleted also returns soft-deleted users.
+	IncludeDeleted bool
+}
+
+// sortColumns maps the sort keys clients may use to the columns they
+// order by. Only these values ever reach an ORDER BY clause.
+var sortColumns = map[string]string{
+	"id":         "id",
+	"name":       "name",
+	"created_at": "created_at",
+}
+
+// SortKey orders results by one of sortColumns.
+type SortKey struct {
+	Column string
+	Desc   bool
+}
+
+type ListUsersParams struct {
+	UserFilter
+	Limit  int
+	Offset int
+	// Sort replaces the default order. Ties are broken by ID so pages stay
+	// stable.
+	Sort []SortKey
+	// After switches to cursor pagination: only users with a larger ID are
+	// returned, ordered by ID even when Query is set.
+	After *int
+}
+
+// UserPage is one page of a user listing.
+type UserPage struct {
+	// Users is never nil.
+	Users []User
+	// Total counts every user matching the filter, on all pages.
+	Total int
+	// NextCursor is only set in cursor mode, and is empty on the last page.
+	NextCursor *string
+}
+
+// listUsersPage counts and lists the users matching params. Every version
+// of the API builds its list response from it.
+func listUsersPage(ctx context.Context, store UserStore, params ListUsersParams) (UserPage, error) {
+	total, err := store.Count(ctx, params.UserFilter)
+	if err != nil {
+		return UserPage{}, err
+	}
+
+	pageSize := params.Limit
+	if params.After != nil {
+		// Fetch one extra row to tell whether another page follows.
+		params.Limit++
+	}
+	users, err := store.List(ctx, params)
+	if err != nil {
+		return UserPage{}, err
+	}
+	if users == nil {
+		users = []User{}
+	}
+
+	page := UserPage{Users: users, Total: total}
+	if params.After != nil {
+		next := ""
+		if len(users) > pageSize {
+			page.Users = users[:pageSize]
+			next = strconv.Itoa(users[pageSize-1].ID)
+		}
+		page.NextCursor = &next
+	}
+	return page, nil
+}
+
+// UserStore is the persistence layer the user handlers depend on.
+type UserStore interface {
+	List(ctx context.Context, params ListUsersParams) ([]User, error)
+	// Stream calls fn for every user matching params as rows are read.
+	Stream(ctx context.Context, params ListUsersParams, fn func(User) error) error
+	Count(ctx context.Context, filter UserFilter) (int, error)
+	Stats(ctx context.Context) (UserStats, error)
+	Get(ctx context.Context, id int, includeDeleted bool) (User, error)
+	// GetMany returns the live users among ids, ordered by ID. Unknown IDs
+	// are skipped.
+	GetMany(ctx context.Context, ids []int) ([]User, error)
+	NameExists(ctx context.Context, name string) (bool, error)
+	EmailExists(ctx context.Context, email string) (bool, error)
+	Create(ctx context.Context, user NewUser) (User, error)
+	// CreateIdempotent creates a user unless key was already used within
+	// ttl, in which case it returns the user from the original request and
+	// replayed is true.
+	CreateIdempotent(ctx context.Context, key string, ttl time.Duration, newUser NewUser) (user User, replayed bool, err error)
+	CreateBatch(ctx context.Context, users []NewUser) ([]User, error)
+	// BulkCreate inserts users with the given names in a single COPY and
+	// returns how many rows were inserted.
+	BulkCreate(ctx context.Context, names []string) (int64, error)
+	Update(ctx context.Context, id int, name string) (User, error)
+	// Patch updates only the non-nil fields of patch.
+	Patch(ctx context.Context, id int, patch UserPatch) (User, error)
+	// Delete soft-deletes the user by setting deleted_at.
+	Delete(ctx context.Context, id int) error
+	// DeleteMany soft-deletes the live users among ids in one transaction
+	// and returns the IDs it deleted.
+	DeleteMany(ctx context.Context, ids []int) ([]int, error)
+	Restore(ctx context.Context, id int) (User, error)
+	// Reset removes every user, including soft-deleted ones, and restarts
+	// the ID sequence. It returns how many users were removed.
+	Reset(ctx context.Context) (int64, error)
+	// ListAudit returns audit entries, newest first. Every mutation above
+	// writes its entry in the same transaction as the change.
+	ListAudit(ctx context.Context, params AuditParams) ([]AuditEntry, error)
+}
+
+// UserStats counts live users, in total and by creation time. Today and
+// this week follow the database's time zone.
+type UserStats struct {
+	Total           int
+	CreatedToday    int
+	CreatedThisWeek int
+}
+
+// NewUser holds the fields of a user that is about to be created. A nil
+// Email stores NULL.
+type NewUser struct {
+	Name  string
+	Email *string
+}
+
+type UserPatch struct {
+	Name *string
+}
+
+// pgUserStore sends writes, and the checks guarding them, to db and plain
+// reads to readDB, which may be a replica lagging slightly behind.
+type pgUserStore struct {
+	db         *pgxpool.Pool
+	readDB     *pgxpool.Pool
+	txIsoLevel pgx.TxIsoLevel
+	retry      retryPolicy
+	breaker    *gobreaker.CircuitBreaker
+}
+
+func newPgUserStore(
+	db, readDB *pgxpool.Pool, txIsoLevel pgx.TxIsoLevel, retries int, breaker *gobreaker.CircuitBreaker,
+) *pgUserStore {
+	return &pgUserStore{
+		db: db, readDB: readDB, txIsoLevel: txIsoLevel, retry: retryPolicy{retries: retries}, breaker: breaker,
+	}
+}
+
+// run calls fn through the circuit breaker, retrying it by the retry policy
+// once admitted. A call that gives up after its retries counts as a single
+// failure.
+func (s *pgUserStore) run(ctx context.Context, idempotent bool, fn func() error) error {
+	_, err := s.breaker.Execute(func() (any, error) {
+		return nil, s.retry.do(ctx, idempotent, fn)
+	})
+	return err
+}
+
+func scanUser(row pgx.Row) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt)
+	return user, err
+}
+
+// uniqueViolation returns the name of the violated constraint, or "" when
+// err is not a unique violation.
+func uniqueViolation(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgUniqueViolationCode {
+		return pgErr.ConstraintName
+	}
+	return ""
+}
+
+// checkViolation returns the name of the violated check constraint, or ""
+// when err is not a check violation.
+func checkViolation(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgCheckViolationCode {
+		return pgErr.ConstraintName
+	}
+	return ""
+}
+
+// translateError maps database errors to the store's sentinel errors.
+func translateError(err error) error {
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrUserNotFound
+	case uniqueViolation(err) == usersEmailConstraint:
+		return ErrEmailExists
+	case uniqueViolation(err) != "":
+		return ErrNameExists
+	case checkViolation(err) == usersNameLengthConstraint:
+		return ErrNameTooLong
+	default:
+		return err
+	}
+}
+
+// withTx runs fn inside a transaction, committing if it returns nil and
+// rolling back if it returns an error or panics. The whole transaction is
+// retried when it failed without taking effect, such as on a serialization
+// failure.
+func (s *pgUserStore) withTx(ctx context.Context, fn func(pgx.Tx) error) error {
+	return s.run(ctx, false, func() error {
+		return s.runTx(ctx, fn)
+	})
+}
+
+func (s *pgUserStore) runTx(ctx context.Context, fn func(pgx.Tx) error) (err error) {
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: s.txIsoLevel})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback(ctx)
+			panic(p)
+		}
+		if err != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	if err = fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// filterConditions returns the WHERE conditions for filter along with
+// their arguments.
+func filterConditions(filter UserFilter) ([]string, []any) {
+	var conds []string
+	var args []any
+	if !filter.IncludeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if filter.Query != "" {
+		args = append(args, escapeLike(filter.Query))
+		conds = append(conds, nameSearchPredicate(len(args)))
+	}
+	return conds, args
+}
+
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+func orderBy(keys []SortKey) string {
+	terms := make([]string, 0, len(keys)+1)
+	hasID := false
+	for _, key := range keys {
+		column, ok := sortColumns[key.Column]
+		if !ok {
+			continue
+		}
+		hasID = hasID || column == "id"
+		if key.Desc {
+			column += " DESC"
+		}
+		terms = append(terms, column)
+	}
+	if !hasID {
+		terms = append(terms, "id")
+	}
+	return strings.Join(terms, ", ")
+}
+
+func listQuery(params ListUsersParams) (string, []any) {
+	var limit any = params.Limit
+	if params.Limit == noLimit {
+		// LIMIT NULL returns every row.
+		limit = nil
+	}
+
+	conds, args := filterConditions(params.UserFilter)
+	order := "id"
+	if params.After != nil {
+		args = append(args, *params.After)
+		conds = append(conds, fmt.Sprintf("id > $%d", len(args)))
+	} else if params.Query != "" {
+		order = "name"
+	}
+
+	if len(params.Sort) > 0 {
+		order = orderBy(params.Sort)
+	}
+
+	query := "SELECT " + userColumns + " FROM users" + whereClause(conds) + " ORDER BY " + order
+	args = append(args, limit)
+	query += fmt.Sprintf(" LIMIT $%d", len(args))
+	if params.After == nil {
+		args = append(args, params.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	return query, args
+}
+
+func (s *pgUserStore) Stream(ctx context.Context, params ListUsersParams, fn func(User) error) error {
+	// Errors from fn are usually the client going away, so they are kept
+	// away from the breaker.
+	var fnErr error
+	_, err := s.breaker.Execute(func() (any, error) {
+		return nil, s.stream(ctx, params, func(user User) error {
+			if fnErr = fn(user); fnErr != nil {
+				return errStreamStopped
+			}
+			return nil
+		})
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// errStreamStopped ends a stream early once its callback has failed.
+var errStreamStopped = errors.New("stream stopped")
+
+// stream runs the list query and calls fn for every row, outside of the
+// breaker so List can run it under its own.
+func (s *pgUserStore) stream(ctx context.Context, params ListUsersParams, fn func(User) error) error {
+	query, args := listQuery(params)
+	rows, err := s.readDB.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *pgUserStore) List(ctx context.Context, params ListUsersParams) ([]User, error) {
+	users := make([]User, 0)
+	err := s.run(ctx, true, func() error {
+		users = users[:0]
+		return s.stream(ctx, params, func(user User) error {
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *pgUserStore) Count(ctx context.Context, filter UserFilter) (int, error) {
+	conds, args := filterConditions(filter)
+	var count int
+	err := s.run(ctx, true, func() error {
+		return s.readDB.QueryRow(ctx, "SELECT COUNT(*) FROM users"+whereClause(conds), args...).Scan(&count)
+	})
+	return count, err
+}
+
+func (s *pgUserStore) Stats(ctx context.Context) (UserStats, error) {
+	var stats UserStats
+	err := s.run(ctx, true, func() error {
+		return s.readDB.QueryRow(ctx, `
+			SELECT
+				COUNT(*),
+				COUNT(*) FILTER (WHERE created_at >= date_trunc('day', now())),
+				COUNT(*) FILTER (WHERE created_at >= date_trunc('week', now()))
+			FROM users
+			WHERE deleted_at IS NULL`,
+		).Scan(&stats.Total, &stats.CreatedToday, &stats.CreatedThisWeek)
+	})
+	return stats, err
+}
+
+func (s *pgUserStore) Get(ctx context.Context, id int, includeDeleted bool) (User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	var user User
+	err := s.run(ctx, true, func() error {
+		var err error
+		user, err = scanUser(s.readDB.QueryRow(ctx, query, id))
+		return err
+	})
+	return user, translateError(err)
+}
+
+func (s *pgUserStore) GetMany(ctx context.Context, ids []int) ([]User, error) {
+	var users []User
+	err := s.run(ctx, true, func() error {
+		rows, err := s.readDB.Query(
+			ctx,
+			"SELECT "+userColumns+" FROM users WHERE id = ANY($1) AND deleted_at IS NULL ORDER BY id",
+			ids,
+		)
+		if err != nil {
+			return err
+		}
+		users, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+			return scanUser(row)
+		})
+		return err
+	})
+	return users, err
+}
+
+func (s *pgUserStore) NameExists(ctx context.Context, name string) (bool, error) {
+	var exists bool
+	err := s.run(ctx, true, func() error {
+		return s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE name = $1 AND deleted_at IS NULL)", name).Scan(&exists)
+	})
+	return exists, err
+}
+
+func (s *pgUserStore) EmailExists(ctx context.Context, email string) (bool, error) {
+	var exists bool
+	err := s.run(ctx, true, func() error {
+		return s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND deleted_at IS NULL)", email).Scan(&exists)
+	})
+	return exists, err
+}
+
+const insertUserQuery = "INSERT INTO users (name, email) VALUES ($1, $2) RETURNING " + userColumns
+
+func insertUser(ctx context.Context, tx pgx.Tx, newUser NewUser) (User, error) {
+	user, err := scanUser(tx.QueryRow(ctx, insertUserQuery, newUser.Name, newUser.Email))
+	if err != nil {
+		return User{}, err
+	}
+	if err := auditUserChange(ctx, tx, auditActionCreate, nil, &user); err != nil {
+		return User{}, err
+	}
+	return user, notifyUserCreated(ctx, tx, user)
+}
+
+// lockUser reads the user for update, so the audited before state is the
+// one the change applies to.
+func lockUser(ctx context.Context, tx pgx.Tx, id int, includeDeleted bool) (User, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE id = $1"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	return scanUser(tx.QueryRow(ctx, query+" FOR UPDATE", id))
+}
+
+func (s *pgUserStore) Create(ctx context.Context, newUser NewUser) (User, error) {
+	var user User
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		user, err = insertUser(ctx, tx, newUser)
+		return err
+	})
+	return user, translateError(err)
+}
+
+func (s *pgUserStore) CreateIdempotent(
+	ctx context.Context, key string, ttl time.Duration, newUser NewUser,
+) (user User, replayed bool, err error) {
+	err = s.withTx(ctx, func(tx pgx.Tx) error {
+		// Serialize requests sharing a key so only one of them inserts.
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", key); err != nil {
+			return err
+		}
+		_, err := tx.Exec(
+			ctx,
+			"DELETE FROM idempotency_keys WHERE created_at < now() - make_interval(secs => $1)",
+			ttl.Seconds(),
+		)
+		if err != nil {
+			return err
+		}
+
+		var stored []byte
+		err = tx.QueryRow(ctx, "SELECT response FROM idempotency_keys WHERE key = $1", key).Scan(&stored)
+		if err == nil {
+			replayed = true
+			return json.Unmarshal(stored, &user)
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		user, err = insertUser(ctx, tx, newUser)
+		if err != nil {
+			return err
+		}
+		response, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "INSERT INTO idempotency_keys (key, response) VALUES ($1, $2)", key, response)
+		return err
+	})
+	return user, replayed, translateError(err)
+}
+
+func (s *pgUserStore) CreateBatch(ctx context.Context, newUsers []NewUser) ([]User, error) {
+	users := make([]User, len(newUsers))
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		batch := &pgx.Batch{}
+		for _, newUser := range newUsers {
+			batch.Queue(insertUserQuery, newUser.Name, newUser.Email)
+		}
+
+		results := tx.SendBatch(ctx, batch)
+		for i := range newUsers {
+			var err error
+			if users[i], err = scanUser(results.QueryRow()); err != nil {
+				_ = results.Close()
+				return fmt.Errorf("users[%d]: %w", i, err)
+			}
+		}
+		if err := results.Close(); err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			if err := auditUserChange(ctx, tx, auditActionCreate, nil, &user); err != nil {
+				return err
+			}
+			if err := notifyUserCreated(ctx, tx, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return users, nil
+}
+
+// BulkCreate trades the returned users and user_created notifications of
+// CreateBatch for COPY throughput.
+func (s *pgUserStore) BulkCreate(ctx context.Context, names []string) (int64, error) {
+	rows := make([][]any, len(names))
+	for i, name := range names {
+		rows[i] = []any{name}
+	}
+	var n int64
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		// COPY can't return the rows it inserts, so it loads a temporary
+		// table that a single INSERT then moves into users, auditing the
+		// rows it returns. ord keeps the IDs in input order.
+		_, err := tx.Exec(
+			ctx,
+			"CREATE TEMPORARY TABLE users_import (ord int GENERATED ALWAYS AS IDENTITY, name text) ON COMMIT DROP",
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"users_import"}, []string{"name"}, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(
+			ctx,
+			`WITH inserted AS (
+				INSERT INTO users (name) SELECT name FROM users_import ORDER BY ord RETURNING *
+			)
+			INSERT INTO audit_log (action, user_id, actor, after)
+			SELECT $1, id, $2, jsonb_strip_nulls(to_jsonb(inserted)) FROM inserted`,
+			auditActionCreate, actorFromContext(ctx),
+		)
+		n = tag.RowsAffected()
+		return err
+	})
+	return n, translateError(err)
+}
+
+func (s *pgUserStore) Update(ctx context.Context, id int, name string) (User, error) {
+	var user User
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, false)
+		if err != nil {
+			return err
+		}
+		user, err = scanUser(tx.QueryRow(
+			ctx, "UPDATE users SET name = $1 WHERE id = $2 RETURNING "+userColumns, name, id,
+		))
+		if err != nil {
+			return err
+		}
+		return auditUserChange(ctx, tx, auditActionUpdate, &before, &user)
+	})
+	return user, translateError(err)
+}
+
+func (s *pgUserStore) Patch(ctx context.Context, id int, patch UserPatch) (User, error) {
+	var sets []string
+	var args []any
+	if patch.Name != nil {
+		args = append(args, *patch.Name)
+		sets = append(sets, fmt.Sprintf("name = $%d", len(args)))
+	}
+	if len(sets) == 0 {
+		return s.Get(ctx, id, false)
+	}
+	args = append(args, id)
+
+	query := fmt.Sprintf(
+		"UPDATE users SET %s WHERE id = $%d RETURNING %s",
+		strings.Join(sets, ", "), len(args), userColumns,
+	)
+	var user User
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, false)
+		if err != nil {
+			return err
+		}
+		if user, err = scanUser(tx.QueryRow(ctx, query, args...)); err != nil {
+			return err
+		}
+		return auditUserChange(ctx, tx, auditActionUpdate, &before, &user)
+	})
+	return user, translateError(err)
+}
+
+func (s *pgUserStore) Delete(ctx context.Context, id int) error {
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, false)
+		if err != nil {
+			return err
+		}
+		after, err := scanUser(tx.QueryRow(
+			ctx, "UPDATE users SET deleted_at = now() WHERE id = $1 RETURNING "+userColumns, id,
+		))
+		if err != nil {
+			return err
+		}
+		return auditUserChange(ctx, tx, auditActionDelete, &before, &after)
+	})
+	return translateError(err)
+}
+
+func (s *pgUserStore) DeleteMany(ctx context.Context, ids []int) ([]int, error) {
+	var deleted []int
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		deleted = deleted[:0]
+		rows, err := tx.Query(
+			ctx,
+			"SELECT "+userColumns+" FROM users WHERE id = ANY($1) AND deleted_at IS NULL FOR UPDATE",
+			ids,
+		)
+		if err != nil {
+			return err
+		}
+		befores, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+			return scanUser(row)
+		})
+		if err != nil {
+			return err
+		}
+
+		rows, err = tx.Query(
+			ctx,
+			"UPDATE users SET deleted_at = now() WHERE id = ANY($1) AND deleted_at IS NULL RETURNING "+userColumns,
+			ids,
+		)
+		if err != nil {
+			return err
+		}
+		afters, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (User, error) {
+			return scanUser(row)
+		})
+		if err != nil {
+			return err
+		}
+
+		byID := make(map[int]User, len(befores))
+		for _, before := range befores {
+			byID[before.ID] = before
+		}
+		for _, after := range afters {
+			before := byID[after.ID]
+			if err := auditUserChange(ctx, tx, auditActionDelete, &before, &after); err != nil {
+				return err
+			}
+			deleted = append(deleted, after.ID)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// Restore clears deleted_at. Restoring a user that is not deleted is a
+// no-op, and it fails with ErrNameExists or ErrEmailExists when a live user
+// took over the name or email in the meantime.
+func (s *pgUserStore) Restore(ctx context.Context, id int) (User, error) {
+	var user User
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		if before.DeletedAt == nil {
+			user = before
+			return nil
+		}
+		user, err = scanUser(tx.QueryRow(
+			ctx, "UPDATE users SET deleted_at = NULL WHERE id = $1 RETURNING "+userColumns, id,
+		))
+		if err != nil {
+			return err
+		}
+		return auditUserChange(ctx, tx, auditActionRestore, &before, &user)
+	})
+	return user, translateError(err)
+}
+
+func (s *pgUserStore) Reset(ctx context.Context) (int64, error) {
+	var n int64
+	err := s.withTx(ctx, func(tx pgx.Tx) error {
+		// Take the lock TRUNCATE needs up front so the count can't go stale.
+		if _, err := tx.Exec(ctx, "LOCK TABLE users IN ACCESS EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, "SELECT count(*) FROM users").Scan(&n); err != nil {
+			return err
+		}
+		// Cached idempotent responses would otherwise replay users that no
+		// longer exist.
+		if _, err := tx.Exec(ctx, "TRUNCATE users, idempotency_keys RESTART IDENTITY"); err != nil {
+			return err
+		}
+		// The audit log is kept: it has to outlive the users it describes.
+		return writeAudit(ctx, tx, auditActionReset, nil, map[string]int64{"deleted": n}, nil)
+	})
+	return n, err
+}
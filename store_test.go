@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestStoreRunRetriesBehindBreaker(t *testing.T) {
+	transient := &pgconn.PgError{Code: "40001"}
+	permanent := errors.New("bad input")
+	tests := []struct {
+		name         string
+		errs         []error // returned by successive calls of fn; nil after
+		wantCalls    int
+		wantErr      error
+		wantFailures uint32
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "recovers after retries", errs: []error{transient, transient}, wantCalls: 3},
+		{
+			name: "gives up after retries", errs: []error{transient, transient, transient},
+			wantCalls: 3, wantErr: transient, wantFailures: 1,
+		},
+		{name: "not retryable", errs: []error{permanent}, wantCalls: 1, wantErr: permanent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := newDBBreaker(2, 1, time.Minute)
+			s := newPgUserStore(nil, nil, pgx.ReadCommitted, 2, breaker)
+
+			calls := 0
+			err := s.run(context.Background(), true, func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("fn called %d times, want %d", calls, tt.wantCalls)
+			}
+			if got := breaker.Counts().ConsecutiveFailures; got != tt.wantFailures {
+				t.Errorf("breaker saw %d consecutive failures, want %d", got, tt.wantFailures)
+			}
+		})
+	}
+}
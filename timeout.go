@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	RequestTimeoutEnvKey  = "REQUEST_TIMEOUT"
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// timeoutWriter passes writes through to w until the request times out,
+// after which they fail with http.ErrHandlerTimeout. Handlers get their own
+// header map so the timeout response never races with them over w's.
+type timeoutWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu          sync.Mutex
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(status int) {
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = append(dst[k], v...)
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeaderLocked(status)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	return tw.w.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+	_ = http.NewResponseController(tw.w).Flush()
+}
+
+// requestTimeout cancels the request context after timeout and responds
+// with a 504 if the handler has not started its response by then. Requests
+// for which exempt returns true, such as long-lived streams, run without a
+// deadline.
+func requestTimeout(timeout time.Duration, exempt func(*http.Request) bool) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exempt(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			tw := &timeoutWriter{w: w, h: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r.WithContext(ctx))
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				// Re-panic on the serving goroutine so recoverPanics sees it.
+				panic(p)
+			case <-done:
+			case <-ctx.Done():
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				logger.WarnContext(r.Context(), "Request timed out", "timeout", timeout)
+				if !tw.wroteHeader {
+					writeError(w, http.StatusGatewayTimeout, "Request timed out")
+				}
+			}
+		})
+	}
+}
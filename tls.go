@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+const (
+	TLSCertFileEnvKey = "TLS_CERT_FILE"
+	TLSKeyFileEnvKey  = "TLS_KEY_FILE"
+)
+
+// certReloader serves the certificate loaded from certFile and keyFile and
+// swaps it for a freshly loaded one on reload, so certificates can be
+// rotated without restarting the server.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate every time the process receives
+// SIGHUP. A failed reload keeps serving the previous certificate.
+func (cr *certReloader) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := cr.reload(); err != nil {
+				logger.Error("Failed to reload TLS certificate, keeping the current one", "error", err)
+				continue
+			}
+			logger.Info("Reloaded TLS certificate", "cert_file", cr.certFile)
+		}
+	}()
+}
+
+// newTLSConfig returns the server TLS config when certFile and keyFile are
+// set, or nil to serve plain HTTP.
+func newTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cr.reloadOnSIGHUP()
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}, nil
+}
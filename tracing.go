@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	OtelEndpointEnvKey = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	serviceName        = "docker-go-app"
+)
+
+// initTracing installs the global W3C trace context propagator and, when an
+// OTLP endpoint is configured, a tracer provider exporting spans to it. The
+// returned function flushes and stops the exporter.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	if os.Getenv(OtelEndpointEnvKey) == "" {
+		logger.Info("Tracing export is disabled", "key", OtelEndpointEnvKey)
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The exporter reads the endpoint and the other OTEL_EXPORTER_OTLP_*
+	// settings from the environment itself.
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.New(
+		ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("Tracing export is enabled", "endpoint", os.Getenv(OtelEndpointEnvKey))
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import "net/http"
+
+// usersV2Path serves users in the v2 shape, where every response is an
+// envelope with the payload under data and anything about it under meta.
+const usersV2Path = "/api/v2/users"
+
+type PageMeta struct {
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+	// NextCursor is only set in cursor mode, and is empty on the last page.
+	NextCursor *string `json:"next_cursor,omitempty"`
+}
+
+type GetUsersV2Response struct {
+	Data []User   `json:"data"`
+	Meta PageMeta `json:"meta"`
+}
+
+type GetUserV2Response struct {
+	Data UserResponse `json:"data"`
+	Meta struct{}     `json:"meta"`
+}
+
+func (app *App) handleGetUsersV2(w http.ResponseWriter, r *http.Request) {
+	params, err := listUsersParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	page, err := listUsersPage(ctx, app.store, params)
+	if err != nil {
+		writeQueryError(ctx, w, err, "Failed to list users", "Error listing users")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, GetUsersV2Response{
+		Data: page.Users,
+		Meta: PageMeta{
+			Total:      page.Total,
+			Limit:      params.Limit,
+			Offset:     params.Offset,
+			NextCursor: page.NextCursor,
+		},
+	})
+}
+
+func (app *App) handleGetUserV2(w http.ResponseWriter, r *http.Request) {
+	if user, ok := app.getUser(w, r); ok {
+		writeJSON(w, http.StatusOK, GetUserV2Response{Data: UserResponse(user)})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	errNameRequired     = errors.New("Name is required")
+	errNameNull         = errors.New("Name cannot be null")
+	errNameControlChars = errors.New("Name must not contain control characters")
+	errEmailInvalid     = errors.New("Email must be a valid address")
+	errNameExists       = errors.New("Name already exists")
+	errEmailExists      = errors.New("Email already exists")
+)
+
+// FieldError describes why one request field is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every invalid field of a request and is sent
+// as the body of a 422 response.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(field string, err error) {
+	e.Errors = append(e.Errors, FieldError{Field: field, Message: err.Error()})
+}
+
+// errOrNil returns e when it holds any errors. It avoids handing callers a
+// non-nil error interface wrapping an empty ValidationError.
+func (e *ValidationError) errOrNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// fieldError returns a ValidationError for a single field.
+func fieldError(field string, err error) *ValidationError {
+	verr := &ValidationError{}
+	verr.add(field, err)
+	return verr
+}
+
+// writeValidationError responds 422 with the field errors of a
+// *ValidationError, and 400 with the message of any other error.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		writeJSON(w, http.StatusUnprocessableEntity, verr)
+		return
+	}
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+// validateName trims surrounding whitespace from name and checks it against
+// the naming rules, returning the normalized name.
+func validateName(name string, maxLength int) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errNameRequired
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", errNameControlChars
+	}
+	if utf8.RuneCountInString(name) > maxLength {
+		return "", fmt.Errorf("Name must be at most %d characters", maxLength)
+	}
+	return name, nil
+}
+
+// validateEmail checks that email is a bare address such as
+// jane@example.com and returns it lowercased, so addresses differing only
+// in case map to the same account.
+func validateEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	addr, err := mail.ParseAddress(email)
+	// ParseAddress also accepts forms like "Jane <jane@example.com>".
+	if err != nil || addr.Address != email {
+		return "", errEmailInvalid
+	}
+	return strings.ToLower(email), nil
+}
+
+// validateNewUser validates and normalizes every field of req. The error
+// is a *ValidationError listing each invalid field.
+func validateNewUser(req AddUserRequest, maxNameLength int) (NewUser, error) {
+	var verr ValidationError
+	name, err := validateName(req.Name, maxNameLength)
+	if err != nil {
+		verr.add("name", err)
+	}
+	newUser := NewUser{Name: name}
+	if req.Email != nil {
+		email, err := validateEmail(*req.Email)
+		if err != nil {
+			verr.add("email", err)
+		}
+		newUser.Email = &email
+	}
+	if err := verr.errOrNil(); err != nil {
+		return NewUser{}, err
+	}
+	return newUser, nil
+}
+
+// handleValidateUser runs the same checks as creating req would, including
+// uniqueness, without inserting anything. It responds 204 when req is valid
+// and 422 with the same ValidationError a real create would return
+// otherwise.
+func (app *App) handleValidateUser(w http.ResponseWriter, r *http.Request, req AddUserRequest) {
+	var verr ValidationError
+	ctx, cancel := app.queryContext(r)
+	defer cancel()
+
+	name, err := validateName(req.Name, app.maxNameLength)
+	if err != nil {
+		verr.add("name", err)
+	} else {
+		exists, err := app.store.NameExists(ctx, name)
+		if err != nil {
+			writeQueryError(ctx, w, err, "Failed to validate user", "Error checking name")
+			return
+		}
+		if exists {
+			verr.add("name", errNameExists)
+		}
+	}
+
+	if req.Email != nil {
+		email, err := validateEmail(*req.Email)
+		if err != nil {
+			verr.add("email", err)
+		} else {
+			exists, err := app.store.EmailExists(ctx, email)
+			if err != nil {
+				writeQueryError(ctx, w, err, "Failed to validate user", "Error checking email")
+				return
+			}
+			if exists {
+				verr.add("email", errEmailExists)
+			}
+		}
+	}
+
+	if err := verr.errOrNil(); err != nil {
+		writeValidationError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=...".
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func buildVersion() VersionResponse {
+	response := VersionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return response
+	}
+	response.GoVersion = info.GoVersion
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if response.Commit == "" {
+				response.Commit = setting.Value
+			}
+		case "vcs.time":
+			if response.BuildTime == "" {
+				response.BuildTime = setting.Value
+			}
+		}
+	}
+	return response
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, buildVersion())
+}